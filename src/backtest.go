@@ -0,0 +1,323 @@
+// 下半身とPPPのシグナルで売買した場合の成績を過去のdailyで検証する
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// バックテストの条件
+type backtestConfig struct {
+	From       string  // 仕掛けを探す期間の最初の日付
+	To         string  // 仕掛けを探す期間の最後の日付
+	MinPPP     pppKind // 仕掛けに必要なPPPの種類の下限. semiPPPならsemiPPPかppp
+	HoldDays   int     // 仕掛けてから何取引日後に手仕舞うか
+	StopLoss   float64 // 仕掛け値からこの比率だけ下がったら損切り. 0なら損切りしない
+	CrossBack  bool    // 終値が下半身の判定に使う移動平均を下回ったら手仕舞うか
+	Commission float64 // 片道の手数料率
+	Size       float64 // 一回の取引に使う資産の比率
+	BodyRule   bool    // trueならローソク足の実体による下半身(checkKahanshinBody)、falseなら前日と前々日の終値による下半身(isKahanshin)で判定
+}
+
+// 一回の取引の結果
+type trade struct {
+	Code       string
+	EntryDate  string
+	EntryPrice float64
+	ExitDate   string
+	ExitPrice  float64
+	Reason     string  // 手仕舞いの理由. hold, stoploss, crossback, end
+	Return     float64 // 手数料を引いた損益率
+}
+
+// 日付ごとの資産の推移
+type equityPoint struct {
+	Date   string
+	Equity float64
+}
+
+// バックテストの集計結果
+type backtestResult struct {
+	Trades      []trade
+	Equity      []equityPoint
+	WinRate     float64
+	AvgReturn   float64
+	TotalReturn float64
+	MaxDrawdown float64
+}
+
+// 過去のdailyで下半身とPPPのシグナルによる売買をシミュレーションしてCSVで返すHandler
+// /backtest?codes=1802,2587&from=2019/01/04&to=2019/05/16&hold=5&stoploss=0.05&crossback=true&commission=0.001&size=0.1&ppp=semiPPP&kahanshin=body&report=summary
+// kahanshinはbody(ローソク足の実体で判定)またはclose(終値で判定)
+// reportはsummary(成績), trades(取引一覧), equity(資産の推移)のどれか
+func backtestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	// read environment values
+	getEnv(r)
+
+	conf, err := parseBacktestConfig(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report := r.FormValue("report")
+	if report == "" {
+		report = "summary"
+	}
+	if report != "summary" && report != "trades" && report != "equity" {
+		http.Error(w, fmt.Sprintf("invalid report: '%s'", report), http.StatusBadRequest)
+		return
+	}
+
+	// cloud sql(ローカルの場合はmysql)と接続
+	db, err := dialSQL(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to open db. err: %v", err)
+		http.Error(w, "failed to open db", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := getCodesParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(codes) == 0 {
+		codes, err = selectLatestCodes(r, db)
+		if err != nil {
+			log.Errorf(ctx, "failed to selectLatestCodes %v", err)
+			http.Error(w, "failed to select codes", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var trades []trade
+	for _, code := range codes {
+		ts, err := backtestCode(r, db, code, conf)
+		if err != nil {
+			log.Warningf(ctx, "failed to backtestCode. code: %s, err: %v", code, err)
+			continue
+		}
+		trades = append(trades, ts...)
+	}
+	res := summarizeTrades(trades, conf.Size)
+	log.Infof(ctx, "backtest done. codes: %d, trades: %d, winRate: %f, avgReturn: %f, maxDrawdown: %f",
+		len(codes), len(res.Trades), res.WinRate, res.AvgReturn, res.MaxDrawdown)
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	switch report {
+	case "summary":
+		cw.Write([]string{"metric", "value"})
+		cw.Write([]string{"trades", strconv.Itoa(len(res.Trades))})
+		cw.Write([]string{"winRate", fmt.Sprintf("%f", res.WinRate)})
+		cw.Write([]string{"avgReturn", fmt.Sprintf("%f", res.AvgReturn)})
+		cw.Write([]string{"totalReturn", fmt.Sprintf("%f", res.TotalReturn)})
+		cw.Write([]string{"maxDrawdown", fmt.Sprintf("%f", res.MaxDrawdown)})
+	case "trades":
+		cw.Write([]string{"code", "entryDate", "entryPrice", "exitDate", "exitPrice", "reason", "return"})
+		for _, t := range res.Trades {
+			cw.Write([]string{t.Code, t.EntryDate, fmt.Sprintf("%f", t.EntryPrice), t.ExitDate, fmt.Sprintf("%f", t.ExitPrice),
+				t.Reason, fmt.Sprintf("%f", t.Return)})
+		}
+	case "equity":
+		cw.Write([]string{"date", "equity"})
+		for _, e := range res.Equity {
+			cw.Write([]string{e.Date, fmt.Sprintf("%f", e.Equity)})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Errorf(ctx, "failed to write csv. %v", err)
+	}
+}
+
+// リクエストのパラメータからバックテストの条件を作る
+func parseBacktestConfig(r *http.Request) (backtestConfig, error) {
+	conf := backtestConfig{MinPPP: semiPPP, HoldDays: 5, StopLoss: 0.05, CrossBack: true, Commission: 0.001, Size: 0.1, BodyRule: true}
+
+	var err error
+	if conf.From, err = getDateParam(r, "from"); err != nil {
+		return conf, err
+	}
+	if conf.To, err = getDateParam(r, "to"); err != nil {
+		return conf, err
+	}
+	if v := r.FormValue("ppp"); v != "" {
+		if conf.MinPPP, err = parsePPPKind(v); err != nil {
+			return conf, err
+		}
+	}
+	if v := r.FormValue("hold"); v != "" {
+		if conf.HoldDays, err = strconv.Atoi(v); err != nil || conf.HoldDays <= 0 {
+			return conf, fmt.Errorf("invalid hold: '%s'", v)
+		}
+	}
+	switch v := r.FormValue("kahanshin"); v {
+	case "", "body":
+	case "close":
+		conf.BodyRule = false
+	default:
+		return conf, fmt.Errorf("invalid kahanshin: '%s'", v)
+	}
+	if v := r.FormValue("crossback"); v != "" {
+		if conf.CrossBack, err = strconv.ParseBool(v); err != nil {
+			return conf, fmt.Errorf("invalid crossback: '%s'", v)
+		}
+	}
+	floats := []struct {
+		key string
+		dst *float64
+	}{{"stoploss", &conf.StopLoss}, {"commission", &conf.Commission}, {"size", &conf.Size}}
+	for _, f := range floats {
+		v := r.FormValue(f.key)
+		if v == "" {
+			continue
+		}
+		if *f.dst, err = strconv.ParseFloat(v, 64); err != nil || *f.dst < 0 {
+			return conf, fmt.Errorf("invalid %s: '%s'", f.key, v)
+		}
+	}
+	return conf, nil
+}
+
+// 一銘柄についてdailyを取得して売買をシミュレーションする
+func backtestCode(r *http.Request, db *sql.DB, code string, conf backtestConfig) ([]trade, error) {
+	bars, err := getOrderedOHLCs(r, db, code, conf.To, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to getOrderedOHLCs. %v", err)
+	}
+	return simulateTrades(r, code, bars, conf), nil
+}
+
+// 直近の日付順に並べた四本値を一日ずつ進めながら売買をシミュレーションする
+// 仕掛けはcalcHandlerと同じcalcPPPKindと下半身の判定を使い、陽線で移動平均を横切った日の終値で買う
+// 下半身の判定に使う移動平均はKAHANSHIN_MOVING_DAYS日(終値で判定する場合は５日)
+// 同じ銘柄で同時に持つのは一回分だけ
+func simulateTrades(r *http.Request, code string, bars []ohlc, conf backtestConfig) []trade {
+	// 移動平均はmovingAvgHandlerと同じmovingAverageで計算するため直近の日付順のまま使う
+	dcs := make([]dateClose, len(bars))
+	for i, b := range bars {
+		dcs[i] = dateClose{Date: b.Date, Close: b.Close}
+	}
+	m5 := movingAverage(r, dcs, 5)
+	m20 := movingAverage(r, dcs, 20)
+	m60 := movingAverage(r, dcs, 60)
+	m100 := movingAverage(r, dcs, 100)
+	mk := m5
+	if conf.BodyRule {
+		mk = movingAverage(r, dcs, kahanshinMovingDays)
+	}
+
+	// movingAverageはデータが足りない古い日付では残りの日数で平均するので、
+	// 一番長い移動平均の日数分のデータがそろった日から見ていく
+	window := 100
+	if kahanshinMovingDays > window {
+		window = kahanshinMovingDays
+	}
+	start := len(dcs) - window
+	if start > len(dcs)-2 {
+		start = len(dcs) - 2
+	}
+
+	// 以下は古い順に見ていく
+	var trades []trade
+	for i := start; i >= 0; i-- {
+		today, yesterday := dcs[i], dcs[i+1]
+		if (conf.From != "" && today.Date < conf.From) || yesterday.Close == 0 {
+			continue
+		}
+		ms := movings{m5[today.Date], m20[today.Date], m60[today.Date], m100[today.Date]}
+		if ms.calcPPPKind() < conf.MinPPP {
+			continue
+		}
+		if conf.BodyRule {
+			if checkKahanshinBody(bars[i].Open, today.Close, mk[today.Date]) != bullishKahanshin {
+				continue
+			}
+		} else {
+			inc := increasingRateInfo{yesterday.Close, today.Close, today.Close / yesterday.Close}
+			if !isKahanshin(inc, ms.Moving5) || inc.IncreasingRate <= 1 {
+				continue
+			}
+		}
+
+		t := trade{Code: code, EntryDate: today.Date, EntryPrice: today.Close}
+		// 手仕舞うまで一日ずつ進める
+		j := i - 1
+		for ; j >= 0; j-- {
+			c := dcs[j].Close
+			if conf.StopLoss > 0 && c <= t.EntryPrice*(1-conf.StopLoss) {
+				t.Reason = "stoploss"
+				break
+			}
+			if conf.CrossBack && c < mk[dcs[j].Date] {
+				t.Reason = "crossback"
+				break
+			}
+			if i-j >= conf.HoldDays {
+				t.Reason = "hold"
+				break
+			}
+		}
+		if j < 0 {
+			// データの最後まで手仕舞わなかった場合は最後の終値で手仕舞う
+			j = 0
+			t.Reason = "end"
+		}
+		t.ExitDate, t.ExitPrice = dcs[j].Date, dcs[j].Close
+		t.Return = t.ExitPrice*(1-conf.Commission)/(t.EntryPrice*(1+conf.Commission)) - 1
+		trades = append(trades, t)
+
+		// 手仕舞った日の翌日から次の仕掛けを探す
+		i = j
+	}
+	return trades
+}
+
+// 取引の一覧から勝率、平均損益率、資産の推移、最大ドローダウンを求める
+// 資産は1から始めて、手仕舞った日ごとに資産のsizeの比率分だけ損益を反映する
+func summarizeTrades(trades []trade, size float64) backtestResult {
+	res := backtestResult{Trades: trades}
+	if len(trades) == 0 {
+		return res
+	}
+	sort.SliceStable(res.Trades, func(i, j int) bool {
+		return res.Trades[i].ExitDate < res.Trades[j].ExitDate
+	})
+
+	wins := 0
+	var sum float64
+	equity, peak := 1.0, 1.0
+	for _, t := range res.Trades {
+		if t.Return > 0 {
+			wins++
+		}
+		sum += t.Return
+		equity *= 1 + size*t.Return
+		// 同じ日に手仕舞った取引はまとめて一点にする
+		if n := len(res.Equity); n > 0 && res.Equity[n-1].Date == t.ExitDate {
+			res.Equity[n-1].Equity = equity
+		} else {
+			res.Equity = append(res.Equity, equityPoint{t.ExitDate, equity})
+		}
+		if equity > peak {
+			peak = equity
+		}
+		if dd := (peak - equity) / peak; dd > res.MaxDrawdown {
+			res.MaxDrawdown = dd
+		}
+	}
+	res.WinRate = float64(wins) / float64(len(res.Trades))
+	res.AvgReturn = sum / float64(len(res.Trades))
+	res.TotalReturn = equity - 1
+	return res
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 古い順にk=0からn-1までの日足を作り、直近の日付順にして返す
+// 終値は100+kで一直線に上がり、始値は終値の1円下なので5日移動平均(終値-2)を横切らない
+// closes, opensで指定した日だけ値を変える
+func trendBars(n int, closes map[int]float64, opens map[int]float64) []ohlc {
+	bars := make([]ohlc, n)
+	for k := 0; k < n; k++ {
+		c := float64(100 + k)
+		if v, ok := closes[k]; ok {
+			c = v
+		}
+		o := c - 1
+		if v, ok := opens[k]; ok {
+			o = v
+		}
+		bars[n-1-k] = ohlc{Date: dayOf(k), Open: o, High: c, Low: o, Close: c}
+	}
+	return bars
+}
+
+// 2019/01/01からk日後の日付
+func dayOf(k int) string {
+	return time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, k).Format("2006/01/02")
+}
+
+func TestSimulateTrades(t *testing.T) {
+	defer func(d int) { kahanshinMovingDays = d }(kahanshinMovingDays)
+	kahanshinMovingDays = 5
+
+	// 100本の移動平均がそろうk=99から仕掛けを探す
+	// k=100: 始値95で5日移動平均198を横切る陽線 -> 5日持ってk=105の205で手仕舞い
+	// k=108: 208で仕掛け、k=110に195まで下がって損切り(208*0.95=197.6以下)
+	// k=116: 216で仕掛け、k=117の213が5日移動平均214.2を下回って手仕舞い
+	// k=120: 220で仕掛け、データの最後k=121の221で手仕舞い
+	bars := trendBars(122,
+		map[int]float64{110: 195, 117: 213},
+		map[int]float64{100: 95, 108: 100, 116: 100, 120: 100})
+	conf := backtestConfig{MinPPP: semiPPP, HoldDays: 5, StopLoss: 0.05, CrossBack: true, Commission: 0.001, Size: 0.1, BodyRule: true}
+	r := httptest.NewRequest("GET", "/backtest", nil)
+
+	ret := func(entry, exit float64) float64 {
+		return exit*(1-conf.Commission)/(entry*(1+conf.Commission)) - 1
+	}
+	want := []trade{
+		{"1802", dayOf(100), 200, dayOf(105), 205, "hold", ret(200, 205)},
+		{"1802", dayOf(108), 208, dayOf(110), 195, "stoploss", ret(208, 195)},
+		{"1802", dayOf(116), 216, dayOf(117), 213, "crossback", ret(216, 213)},
+		{"1802", dayOf(120), 220, dayOf(121), 221, "end", ret(220, 221)},
+	}
+	got := simulateTrades(r, "1802", bars, conf)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("simulateTrades() = %+v, want %+v", got, want)
+	}
+
+	// fromより前の日には仕掛けない
+	conf.From = dayOf(106)
+	if got := simulateTrades(r, "1802", bars, conf); !reflect.DeepEqual(got, want[1:]) {
+		t.Errorf("simulateTrades() from %s = %+v, want %+v", conf.From, got, want[1:])
+	}
+
+	// 損切りも移動平均による手仕舞いもしなければk=110の下落でも持ち続ける
+	conf = backtestConfig{MinPPP: semiPPP, HoldDays: 5, Commission: 0, BodyRule: true}
+	want = []trade{
+		{"1802", dayOf(100), 200, dayOf(105), 205, "hold", ret(200, 205)},
+		{"1802", dayOf(108), 208, dayOf(113), 213, "hold", ret(208, 213)},
+		{"1802", dayOf(116), 216, dayOf(121), 221, "hold", ret(216, 221)},
+	}
+	if got := simulateTrades(r, "1802", bars, conf); !reflect.DeepEqual(got, want) {
+		t.Errorf("simulateTrades() without stoploss = %+v, want %+v", got, want)
+	}
+
+	// 移動平均のそろう日数がなければ仕掛けない
+	if got := simulateTrades(r, "1802", trendBars(50, nil, map[int]float64{45: 100}), conf); len(got) != 0 {
+		t.Errorf("simulateTrades() with short bars = %+v, want none", got)
+	}
+}
+
+func TestSummarizeTrades(t *testing.T) {
+	// 手仕舞った日の順でないものと同じ日に手仕舞ったものを含む
+	trades := []trade{
+		{Code: "1802", ExitDate: "2019/05/14", Return: -0.2},
+		{Code: "2587", ExitDate: "2019/05/13", Return: 0.1},
+		{Code: "1802", ExitDate: "2019/05/16", Return: 0},
+		{Code: "2587", ExitDate: "2019/05/14", Return: 0.1},
+	}
+	got := summarizeTrades(trades, 0.5)
+
+	// 資産は1 -> 1.05 -> 0.945 -> 0.99225 -> 0.99225
+	wantEquity := []equityPoint{{"2019/05/13", 1.05}, {"2019/05/14", 0.99225}, {"2019/05/16", 0.99225}}
+	if len(got.Equity) != len(wantEquity) {
+		t.Fatalf("summarizeTrades() Equity = %v, want %v", got.Equity, wantEquity)
+	}
+	for i, e := range wantEquity {
+		if got.Equity[i].Date != e.Date || !almostEqual(got.Equity[i].Equity, e.Equity, 1e-9) {
+			t.Errorf("summarizeTrades() Equity[%d] = %v, want %v", i, got.Equity[i], e)
+		}
+	}
+	var exits []string
+	for _, tr := range got.Trades {
+		exits = append(exits, tr.ExitDate)
+	}
+	if want := []string{"2019/05/13", "2019/05/14", "2019/05/14", "2019/05/16"}; !reflect.DeepEqual(exits, want) {
+		t.Errorf("summarizeTrades() trades order = %v, want %v", exits, want)
+	}
+	// 損益0は勝ちに数えない
+	if got.WinRate != 0.5 {
+		t.Errorf("summarizeTrades() WinRate = %v, want 0.5", got.WinRate)
+	}
+	if !almostEqual(got.AvgReturn, 0, 1e-9) {
+		t.Errorf("summarizeTrades() AvgReturn = %v, want 0", got.AvgReturn)
+	}
+	if !almostEqual(got.TotalReturn, -0.00775, 1e-9) {
+		t.Errorf("summarizeTrades() TotalReturn = %v, want -0.00775", got.TotalReturn)
+	}
+	// 最大ドローダウンは1.05から0.945まで下がったとき
+	if !almostEqual(got.MaxDrawdown, 0.1, 1e-9) {
+		t.Errorf("summarizeTrades() MaxDrawdown = %v, want 0.1", got.MaxDrawdown)
+	}
+
+	if got := summarizeTrades(nil, 0.5); !reflect.DeepEqual(got, backtestResult{}) {
+		t.Errorf("summarizeTrades(nil) = %+v, want empty", got)
+	}
+}
@@ -0,0 +1,288 @@
+// dailyの全銘柄を集計した騰落数や移動平均線より上の銘柄の割合などの市場全体の指標
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// 騰落レシオの日数
+	adRatioDays = 25
+	// 集計に必要な取引日数. 75日移動平均の分
+	breadthHistoryDays = 75
+	// breadthシートに出力する日数
+	breadthSheetDays = 100
+)
+
+// breadthテーブルの項目名
+var breadthColumns = []string{"date", "advances", "declines", "unchanged", "adratio", "adratio25",
+	"above25", "above75", "ppp", "semippp", "non", "oppositesemippp", "oppositeppp"}
+
+// 一日分の市場全体の指標
+type breadth struct {
+	Date            string
+	Advances        int     // 前の取引日より終値が上がった銘柄数
+	Declines        int     // 前の取引日より終値が下がった銘柄数
+	Unchanged       int     // 前の取引日と終値が同じ銘柄数
+	ADRatio         float64 // 値上がり銘柄数 / 値下がり銘柄数
+	ADRatio25       float64 // 25日騰落レシオ(%). 25日間の値上がり銘柄数の合計 / 値下がり銘柄数の合計 * 100
+	Above25         float64 // 終値が25日移動平均より上の銘柄の割合(%)
+	Above75         float64 // 終値が75日移動平均より上の銘柄の割合(%)
+	PPP             int     // PPPの種類ごとの銘柄数
+	SemiPPP         int
+	Non             int
+	OppositeSemiPPP int
+	OppositePPP     int
+}
+
+// breadthテーブルに書き込むレコードを作る
+func (b *breadth) record() []string {
+	return []string{b.Date, strconv.Itoa(b.Advances), strconv.Itoa(b.Declines), strconv.Itoa(b.Unchanged),
+		fmt.Sprintf("%f", b.ADRatio), fmt.Sprintf("%f", b.ADRatio25), fmt.Sprintf("%f", b.Above25), fmt.Sprintf("%f", b.Above75),
+		strconv.Itoa(b.PPP), strconv.Itoa(b.SemiPPP), strconv.Itoa(b.Non), strconv.Itoa(b.OppositeSemiPPP), strconv.Itoa(b.OppositePPP)}
+}
+
+// 直近の取引日の市場全体の指標を計算してbreadthテーブルとbreadthシートに書き込むHandler
+// /breadth?date=2019/05/16 のように日付を指定した場合はその日付で計算し直す
+func breadthHandler(w http.ResponseWriter, r *http.Request) {
+	processStartTime := time.Now().UTC()
+	// GAE log
+	ctx := appengine.NewContext(r)
+
+	// get environment var, sheet, db
+	sheet, db, err := initialize(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to initialize. err: %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to initialize. got environment var, sheet, db.")
+
+	// 休日データを取得
+	cal := getTradingCalendar(r, sheet, db)
+	now := cal.Now()
+
+	// test環境ではデータの存在する最新の日付に合わせる
+	previousBussinessDay := "2019/05/16"
+	date, err := getDateParam(r, "date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if date != "" {
+		previousBussinessDay = date
+	} else if runEnv != "test" {
+		// 前の日が休みの日だったら集計するデータがないので起動しない
+		if !cal.PreviousDayOpen() {
+			log.Infof(ctx, "Previous day is not business day.")
+			return
+		}
+		previousBussinessDay = cal.Prev(now).Format("2006/01/02")
+	}
+	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
+
+	b, err := calcBreadth(r, db, previousBussinessDay)
+	if err != nil {
+		log.Errorf(ctx, "failed to calcBreadth. %v", err)
+		os.Exit(0)
+	}
+	if _, err := replaceDB(r, db, "breadth", breadthColumns, [][]string{b.record()}); err != nil {
+		log.Errorf(ctx, "failed to replaceDB. %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to write breadth. %+v", b)
+
+	// 直近breadthSheetDays日分の推移をbreadthシートに書き込む
+	bs, err := getBreadths(r, db, previousBussinessDay, breadthSheetDays)
+	if err != nil {
+		log.Errorf(ctx, "failed to getBreadths. %v", err)
+		os.Exit(0)
+	}
+	records := [][]interface{}{getColumnName(&breadth{})}
+	for i := range bs {
+		records = append(records, toInterfaceSlice(&bs[i]))
+	}
+	if err := clearAndWriteSheet(sheet, calcSheetID, "breadth", records); err != nil {
+		log.Errorf(ctx, "failed to clearAndWriteSheet. %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "done breadthHandler. Elapsed time %v.", time.Since(processStartTime))
+}
+
+// dailyにある日付のうち、指定した日付以前の直近n日分を直近の順に返す
+func getRecentDates(r *http.Request, db *sql.DB, date string, n int) ([]string, error) {
+	return selectTable(r, db, fmt.Sprintf(
+		"SELECT DISTINCT date FROM daily WHERE date <= '%s' ORDER BY date DESC LIMIT %d;", date, n))
+}
+
+// 指定した日付の市場全体の指標を計算する
+// 騰落と移動平均はdailyの終値(USE_MODIFIED_CLOSEがtrueなら修正後終値)、PPPの種類はmovingavgから求める
+func calcBreadth(r *http.Request, db *sql.DB, date string) (breadth, error) {
+	// 騰落レシオには前日比を求めるため一日多く必要
+	n := breadthHistoryDays
+	if adRatioDays+1 > n {
+		n = adRatioDays + 1
+	}
+	dates, err := getRecentDates(r, db, date, n)
+	if err != nil {
+		return breadth{}, fmt.Errorf("failed to getRecentDates. %v", err)
+	}
+	if len(dates) == 0 || dates[0] != date {
+		return breadth{}, fmt.Errorf("no daily data on %s", date)
+	}
+	dateIndex := make(map[string]int)
+	for i, d := range dates {
+		dateIndex[d] = i
+	}
+
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT code, date, %s FROM daily WHERE date >= '%s' AND date <= '%s';", closeColumn(), dates[len(dates)-1], date))
+	if err != nil {
+		return breadth{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	// 銘柄ごとに直近の日付順の終値を並べる. データがない日は0
+	closes := make(map[string][]float64)
+	for i := 0; i+2 < len(ret); i += 3 {
+		c, err := strconv.ParseFloat(ret[i+2], 64)
+		if err != nil {
+			return breadth{}, fmt.Errorf("failed to ParseFloat. code: %s, date: %s, %v", ret[i], ret[i+1], err)
+		}
+		if _, ok := closes[ret[i]]; !ok {
+			closes[ret[i]] = make([]float64, len(dates))
+		}
+		closes[ret[i]][dateIndex[ret[i+1]]] = c
+	}
+
+	b := breadth{Date: date}
+	var advances25, declines25, above25, above75, count25, count75 int
+	for _, cs := range closes {
+		// 直近の日に終値がない銘柄は集計しない
+		if cs[0] == 0 {
+			continue
+		}
+		for d := 0; d < adRatioDays && d+1 < len(cs); d++ {
+			if cs[d] == 0 || cs[d+1] == 0 {
+				continue
+			}
+			if cs[d] > cs[d+1] {
+				advances25++
+				if d == 0 {
+					b.Advances++
+				}
+			} else if cs[d] < cs[d+1] {
+				declines25++
+				if d == 0 {
+					b.Declines++
+				}
+			} else if d == 0 {
+				b.Unchanged++
+			}
+		}
+		if avg, ok := averageOfFull(cs, 25); ok {
+			count25++
+			if cs[0] > avg {
+				above25++
+			}
+		}
+		if avg, ok := averageOfFull(cs, 75); ok {
+			count75++
+			if cs[0] > avg {
+				above75++
+			}
+		}
+	}
+	if b.Declines != 0 {
+		b.ADRatio = float64(b.Advances) / float64(b.Declines)
+	}
+	if declines25 != 0 {
+		b.ADRatio25 = float64(advances25) / float64(declines25) * 100
+	}
+	if count25 != 0 {
+		b.Above25 = float64(above25) / float64(count25) * 100
+	}
+	if count75 != 0 {
+		b.Above75 = float64(above75) / float64(count75) * 100
+	}
+
+	ms, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT moving5, moving20, moving60, moving100 FROM movingavg WHERE date = '%s';", date))
+	if err != nil {
+		return breadth{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	for i := 0; i+3 < len(ms); i += 4 {
+		var fs [4]float64
+		for j := range fs {
+			if fs[j], err = strconv.ParseFloat(ms[i+j], 64); err != nil {
+				return breadth{}, fmt.Errorf("failed to ParseFloat %v", err)
+			}
+		}
+		switch (movings{fs[0], fs[1], fs[2], fs[3]}).calcPPPKind() {
+		case ppp:
+			b.PPP++
+		case semiPPP:
+			b.SemiPPP++
+		case non:
+			b.Non++
+		case oppositeSemiPPP:
+			b.OppositeSemiPPP++
+		case oppositePPP:
+			b.OppositePPP++
+		}
+	}
+	return b, nil
+}
+
+// 直近の日付順の終値から直近days日の平均を返す
+// 途中に終値のない日がある場合は平均を求めない
+func averageOfFull(cs []float64, days int) (float64, bool) {
+	if len(cs) < days {
+		return 0, false
+	}
+	var sum float64
+	for _, c := range cs[:days] {
+		if c == 0 {
+			return 0, false
+		}
+		sum += c
+	}
+	return sum / float64(days), true
+}
+
+// 指定した日付以前の直近limit日分のbreadthを直近の順に返す
+func getBreadths(r *http.Request, db *sql.DB, date string, limit int) ([]breadth, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT %s FROM breadth WHERE date <= '%s' ORDER BY date DESC LIMIT %d;", strings.Join(breadthColumns, ","), date, limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+
+	n := len(breadthColumns)
+	var bs []breadth
+	for i := 0; i+n-1 < len(ret); i += n {
+		row := ret[i : i+n]
+		var is [8]int
+		var fs [4]float64
+		for j, k := range []int{1, 2, 3, 8, 9, 10, 11, 12} {
+			if is[j], err = strconv.Atoi(row[k]); err != nil {
+				return nil, fmt.Errorf("failed to Atoi. date: %s, %v", row[0], err)
+			}
+		}
+		for j := range fs {
+			if fs[j], err = strconv.ParseFloat(row[4+j], 64); err != nil {
+				return nil, fmt.Errorf("failed to ParseFloat. date: %s, %v", row[0], err)
+			}
+		}
+		bs = append(bs, breadth{Date: row[0], Advances: is[0], Declines: is[1], Unchanged: is[2],
+			ADRatio: fs[0], ADRatio25: fs[1], Above25: fs[2], Above75: fs[3],
+			PPP: is[3], SemiPPP: is[4], Non: is[5], OppositeSemiPPP: is[6], OppositePPP: is[7]})
+	}
+	return bs, nil
+}
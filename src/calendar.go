@@ -0,0 +1,153 @@
+// 東京証券取引所(JPX)の休業日を祝日法などの規則から求める
+// holidaysテーブルまたはholidayシートは規則で求められない臨時の休業日や取引日を上書きするためだけに使う
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// 規則から休業日を求める最初の年
+const calendarFirstYear = 2000
+
+// 法律で特別に定められた年ごとの祝日の変更(即位の礼や東京オリンピックによる移動など)
+// addは規則で求めた祝日に足す日付、removeは規則で求めた祝日から除く日付
+var specialHolidays = map[int]struct {
+	add    []string
+	remove []string
+}{
+	2019: {add: []string{"2019/04/30", "2019/05/01", "2019/05/02", "2019/10/22"}},
+	2020: {add: []string{"2020/07/23", "2020/07/24", "2020/08/10"}, remove: []string{"2020/07/20", "2020/08/11", "2020/10/12"}},
+	2021: {add: []string{"2021/07/22", "2021/07/23", "2021/08/08"}, remove: []string{"2021/07/19", "2021/08/11", "2021/10/11"}},
+}
+
+// 月のn番目の月曜日
+func nthMonday(year int, month time.Month, n int) time.Time {
+	t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	offset := (int(time.Monday) - int(t.Weekday()) + 7) % 7
+	return t.AddDate(0, 0, offset+(n-1)*7)
+}
+
+// 春分の日と秋分の日の日にち(1980年から2099年まで使える近似式)
+func equinoxDays(year int) (int, int) {
+	y := float64(year - 1980)
+	leap := (year - 1980) / 4
+	return int(20.8431+0.242194*y) - leap, int(23.2488+0.242194*y) - leap
+}
+
+// 祝日法による国民の祝日(振替休日と国民の休日は含まない)
+func nationalHolidays(year int) map[string]bool {
+	days := make(map[string]bool)
+	add := func(t time.Time) {
+		days[t.Format("2006/01/02")] = true
+	}
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(year, m, d, 0, 0, 0, 0, time.UTC)
+	}
+	vernal, autumnal := equinoxDays(year)
+
+	add(date(time.January, 1))            // 元日
+	add(nthMonday(year, time.January, 2)) // 成人の日
+	add(date(time.February, 11))          // 建国記念の日
+	add(date(time.March, vernal))         // 春分の日
+	add(date(time.April, 29))             // 昭和の日(2006年まではみどりの日)
+	add(date(time.May, 3))                // 憲法記念日
+	add(date(time.May, 5))                // こどもの日
+	add(date(time.September, autumnal))   // 秋分の日
+	add(nthMonday(year, time.October, 2)) // スポーツの日(2019年までは体育の日)
+	add(date(time.November, 3))           // 文化の日
+	add(date(time.November, 23))          // 勤労感謝の日
+	if year >= 2003 {
+		add(nthMonday(year, time.July, 3))      // 海の日
+		add(nthMonday(year, time.September, 3)) // 敬老の日
+	} else {
+		add(date(time.July, 20))
+		add(date(time.September, 15))
+	}
+	if year >= 2007 {
+		add(date(time.May, 4)) // みどりの日
+	}
+	if year >= 2016 {
+		add(date(time.August, 11)) // 山の日
+	}
+	if year <= 2018 {
+		add(date(time.December, 23)) // 天皇誕生日(平成)
+	}
+	if year >= 2020 {
+		add(date(time.February, 23)) // 天皇誕生日(令和)
+	}
+
+	if sp, ok := specialHolidays[year]; ok {
+		for _, d := range sp.remove {
+			delete(days, d)
+		}
+		for _, d := range sp.add {
+			days[d] = true
+		}
+	}
+	return days
+}
+
+// 一年分のJPXの休業日(土日を除く)を返す
+// 国民の祝日、振替休日、国民の休日と年末年始(12/31から1/3)
+func jpxHolidays(year int) map[string]bool {
+	holidays := nationalHolidays(year)
+
+	// 振替休日: 祝日が日曜日の場合はその後の最初の祝日でない日
+	// 国民の休日: 前日と翌日が祝日の平日
+	// 年をまたぐものはないので一年の中だけで判定する
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	extra := make(map[string]bool)
+	for t := first; t.Year() == year; t = t.AddDate(0, 0, 1) {
+		d := t.Format("2006/01/02")
+		if holidays[d] && t.Weekday() == time.Sunday {
+			s := t.AddDate(0, 0, 1)
+			for holidays[s.Format("2006/01/02")] {
+				s = s.AddDate(0, 0, 1)
+			}
+			extra[s.Format("2006/01/02")] = true
+		}
+		if !holidays[d] && t.Weekday() != time.Sunday &&
+			holidays[t.AddDate(0, 0, -1).Format("2006/01/02")] && holidays[t.AddDate(0, 0, 1).Format("2006/01/02")] {
+			extra[d] = true
+		}
+	}
+	for d := range extra {
+		holidays[d] = true
+	}
+
+	// 年末年始の休業日
+	for _, md := range []string{"01/01", "01/02", "01/03", "12/31"} {
+		holidays[first.Format("2006")+"/"+md] = true
+	}
+	return holidays
+}
+
+// calendarFirstYearから翌年までの取引所の規則で求めた休業日に、holidaysテーブルまたはholidayシートの上書きを反映した休日一覧Mapを返す
+// 上書きで休業日とした日付は足し、取引日とした日付は除く
+func getHolidays(r *http.Request, srv *sheets.Service, db *sql.DB, exchange string) map[string]bool {
+	ctx := appengine.NewContext(r)
+
+	holidayMap := make(map[string]bool)
+	for y := calendarFirstYear; y <= time.Now().Year()+1; y++ {
+		for d := range exchangeHolidays[exchange].rules(y) {
+			holidayMap[d] = true
+		}
+	}
+
+	overrides := getHolidayOverrides(r, srv, db, exchange)
+	for d, closed := range overrides {
+		if closed {
+			holidayMap[d] = true
+		} else {
+			delete(holidayMap, d)
+		}
+	}
+	log.Infof(ctx, "got %d holidays. exchange: %s, overrides: %d", len(holidayMap), exchange, len(overrides))
+	return holidayMap
+}
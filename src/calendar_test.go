@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// 休業日のMapから土日を除いた日付を古い順に返す
+func weekdayHolidays(holidays map[string]bool) []string {
+	var days []string
+	for d := range holidays {
+		t, err := time.Parse("2006/01/02", d)
+		if err != nil || isSaturdayOrSunday(t) {
+			continue
+		}
+		days = append(days, d)
+	}
+	sort.Strings(days)
+	return days
+}
+
+func TestEquinoxDays(t *testing.T) {
+	tests := []struct {
+		year     int
+		vernal   int
+		autumnal int
+	}{
+		{2012, 20, 22},
+		{2015, 21, 23},
+		{2019, 21, 23},
+		{2020, 20, 22},
+		{2024, 20, 22},
+	}
+	for _, tt := range tests {
+		if v, a := equinoxDays(tt.year); v != tt.vernal || a != tt.autumnal {
+			t.Errorf("equinoxDays(%d) = %d, %d, want %d, %d", tt.year, v, a, tt.vernal, tt.autumnal)
+		}
+	}
+}
+
+// 東証の公表している休業日(土日を除く)
+func TestJPXHolidays(t *testing.T) {
+	tests := []struct {
+		year int
+		want []string
+	}{
+		{
+			// 5/3(日)の振替休日が5/4, 5/5の祝日の後の5/6になる. 9/22は敬老の日と秋分の日に挟まれた国民の休日
+			year: 2015,
+			want: []string{
+				"2015/01/01", "2015/01/02", "2015/01/12", "2015/02/11", "2015/04/29",
+				"2015/05/04", "2015/05/05", "2015/05/06", "2015/07/20", "2015/09/21",
+				"2015/09/22", "2015/09/23", "2015/10/12", "2015/11/03", "2015/11/23",
+				"2015/12/23", "2015/12/31",
+			},
+		},
+		{
+			// 即位の日と前後の国民の休日、即位礼正殿の儀. 天皇誕生日はない
+			year: 2019,
+			want: []string{
+				"2019/01/01", "2019/01/02", "2019/01/03", "2019/01/14", "2019/02/11",
+				"2019/03/21", "2019/04/29", "2019/04/30", "2019/05/01", "2019/05/02",
+				"2019/05/03", "2019/05/06", "2019/07/15", "2019/08/12", "2019/09/16",
+				"2019/09/23", "2019/10/14", "2019/10/22", "2019/11/04", "2019/12/31",
+			},
+		},
+		{
+			// 東京オリンピックによる海の日、スポーツの日、山の日の移動. 2/23(日)の振替休日
+			year: 2020,
+			want: []string{
+				"2020/01/01", "2020/01/02", "2020/01/03", "2020/01/13", "2020/02/11",
+				"2020/02/24", "2020/03/20", "2020/04/29", "2020/05/04", "2020/05/05",
+				"2020/05/06", "2020/07/23", "2020/07/24", "2020/08/10", "2020/09/21",
+				"2020/09/22", "2020/11/03", "2020/11/23", "2020/12/31",
+			},
+		},
+		{
+			// 海の日、敬老の日が固定日だった年. 日曜日の祝日の振替休日と、5/4の国民の休日
+			year: 2001,
+			want: []string{
+				"2001/01/01", "2001/01/02", "2001/01/03", "2001/01/08", "2001/02/12",
+				"2001/03/20", "2001/04/30", "2001/05/03", "2001/05/04", "2001/07/20",
+				"2001/09/24", "2001/10/08", "2001/11/23", "2001/12/24", "2001/12/31",
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := weekdayHolidays(jpxHolidays(tt.year)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("jpxHolidays(%d) = %v, want %v", tt.year, got, tt.want)
+		}
+	}
+}
+
+func TestNthMonday(t *testing.T) {
+	tests := []struct {
+		year  int
+		month time.Month
+		n     int
+		want  string
+	}{
+		{2019, time.January, 2, "2019/01/14"},
+		{2019, time.July, 3, "2019/07/15"},
+		{2018, time.October, 2, "2018/10/08"},
+		// 1日が月曜日の月
+		{2018, time.October, 1, "2018/10/01"},
+	}
+	for _, tt := range tests {
+		if got := nthMonday(tt.year, tt.month, tt.n).Format("2006/01/02"); got != tt.want {
+			t.Errorf("nthMonday(%d, %v, %d) = %s, want %s", tt.year, tt.month, tt.n, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// 四本値からローソク足のパターンを判定する
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// 判定するローソク足のパターン名
+const (
+	bullishEngulfing   = "bullishEngulfing"   // 陽の包み足
+	bearishEngulfing   = "bearishEngulfing"   // 陰の包み足
+	hammer             = "hammer"             // 下落後のカラカサ(たくり線)
+	hangingMan         = "hangingMan"         // 上昇後のカラカサ(首吊り線)
+	doji               = "doji"               // 十字線
+	threeWhiteSoldiers = "threeWhiteSoldiers" // 赤三兵
+	morningStar        = "morningStar"        // 明けの明星
+	eveningStar        = "eveningStar"        // 宵の明星
+)
+
+// ローソク足のパターンの判定に使う値
+const (
+	candleTrendDays    = 5   // hammer, hangingManの判定で前のトレンドを見る日数
+	dojiBodyRatio      = 0.1 // 実体が値幅のこの比率以下なら十字線
+	smallBodyRatio     = 0.3 // 星や実体の小さい足とみなす値幅に対する比率
+	hammerShadowToBody = 2.0 // カラカサの下ヒゲが実体の何倍以上か
+)
+
+// ローソク足のパターン
+type candleInfo struct {
+	CandlePatterns string // その日に当てはまるパターンをカンマ区切りで並べたもの. なければ空
+	BullishCandle  bool   // 上昇を示すパターン(bullishPatterns)のどれかに当てはまるか
+}
+
+// 下半身の陽線を確認するのに使う上昇を示すパターン
+var bullishPatterns = []string{bullishEngulfing, hammer, morningStar, threeWhiteSoldiers}
+
+// 実体の大きさ
+func (o ohlc) body() float64 {
+	return math.Abs(o.Close - o.Open)
+}
+
+// 高値と安値の値幅
+func (o ohlc) rangeWidth() float64 {
+	return o.High - o.Low
+}
+
+func (o ohlc) isBullish() bool {
+	return o.Close > o.Open
+}
+
+func (o ohlc) isBearish() bool {
+	return o.Close < o.Open
+}
+
+// 実体が値幅に比べて小さいか
+func (o ohlc) isSmallBody(ratio float64) bool {
+	return o.rangeWidth() > 0 && o.body() <= o.rangeWidth()*ratio
+}
+
+// 古い順に並べた四本値の位置iの日に当てはまるパターンを返す
+// 前の日数が足りないパターンは判定しない
+func candlePatterns(bars []ohlc, i int) []string {
+	var patterns []string
+	cur := bars[i]
+
+	if cur.isSmallBody(dojiBodyRatio) {
+		patterns = append(patterns, doji)
+	}
+
+	// カラカサ: 実体が上の方にあり、下ヒゲが実体の2倍以上で上ヒゲがほとんどない
+	// 前のトレンドが下落ならhammer, 上昇ならhangingMan
+	if i >= candleTrendDays && cur.body() > 0 {
+		lower := math.Min(cur.Open, cur.Close) - cur.Low
+		upper := cur.High - math.Max(cur.Open, cur.Close)
+		if lower >= cur.body()*hammerShadowToBody && upper <= cur.body() {
+			prev := bars[i-candleTrendDays].Close
+			if bars[i-1].Close < prev {
+				patterns = append(patterns, hammer)
+			} else if bars[i-1].Close > prev {
+				patterns = append(patterns, hangingMan)
+			}
+		}
+	}
+
+	if i >= 1 {
+		prev := bars[i-1]
+		// 包み足: 前日の実体を今日の逆向きの実体が包む
+		if prev.isBearish() && cur.isBullish() && cur.Open <= prev.Close && cur.Close >= prev.Open && cur.body() > prev.body() {
+			patterns = append(patterns, bullishEngulfing)
+		}
+		if prev.isBullish() && cur.isBearish() && cur.Open >= prev.Close && cur.Close <= prev.Open && cur.body() > prev.body() {
+			patterns = append(patterns, bearishEngulfing)
+		}
+	}
+
+	if i >= 2 {
+		first, star := bars[i-2], bars[i-1]
+		firstMid := (first.Open + first.Close) / 2
+		// 明けの明星: 大陰線、実体の小さい足、前々日の実体の半分以上まで戻す陽線
+		if first.isBearish() && !first.isSmallBody(smallBodyRatio) && star.isSmallBody(smallBodyRatio) &&
+			math.Max(star.Open, star.Close) < first.Close && cur.isBullish() && cur.Close > firstMid {
+			patterns = append(patterns, morningStar)
+		}
+		// 宵の明星: 大陽線、実体の小さい足、前々日の実体の半分以下まで下げる陰線
+		if first.isBullish() && !first.isSmallBody(smallBodyRatio) && star.isSmallBody(smallBodyRatio) &&
+			math.Min(star.Open, star.Close) > first.Close && cur.isBearish() && cur.Close < firstMid {
+			patterns = append(patterns, eveningStar)
+		}
+		// 赤三兵: 3日続けて終値を切り上げる陽線で、始値は前日の実体の中にある
+		if first.isBullish() && star.isBullish() && cur.isBullish() &&
+			star.Close > first.Close && cur.Close > star.Close &&
+			star.Open >= first.Open && star.Open <= first.Close && cur.Open >= star.Open && cur.Open <= star.Close {
+			patterns = append(patterns, threeWhiteSoldiers)
+		}
+	}
+	return patterns
+}
+
+// 古い順に並べた四本値からcandlesテーブルのレコードを作る
+// パターンのない日も空で保存する
+func calcCandleRecords(code string, bars []ohlc) [][]string {
+	var records [][]string
+	for i := storeStart(len(bars), candleTrendDays); i < len(bars); i++ {
+		records = append(records, []string{code, bars[i].Date, strings.Join(candlePatterns(bars, i), ",")})
+	}
+	return records
+}
+
+// 銘柄コード、日付を渡すと該当のcandleInfo structに対応するローソク足のパターンを返す
+func getCandleInfo(r *http.Request, db *sql.DB, code string, date string) (candleInfo, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT patterns FROM candles WHERE code = %s and date = '%s';", code, date))
+	if err != nil {
+		return candleInfo{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(ret) != 1 {
+		return candleInfo{}, fmt.Errorf("no selected data")
+	}
+	info := candleInfo{CandlePatterns: ret[0]}
+	for _, p := range strings.Split(ret[0], ",") {
+		for _, b := range bullishPatterns {
+			if p == b {
+				info.BullishCandle = true
+			}
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCandlePatterns(t *testing.T) {
+	// 前の5日間の下落トレンドと上昇トレンド
+	downtrend := []ohlc{
+		bar("2019/05/07", 122, 123, 119, 120, 0),
+		bar("2019/05/08", 118, 119, 115, 116, 0),
+		bar("2019/05/09", 114, 115, 111, 112, 0),
+		bar("2019/05/10", 110, 111, 107, 108, 0),
+		bar("2019/05/13", 106, 107, 103, 104, 0),
+	}
+	uptrend := []ohlc{
+		bar("2019/05/07", 78, 81, 77, 80, 0),
+		bar("2019/05/08", 82, 85, 81, 84, 0),
+		bar("2019/05/09", 86, 89, 85, 88, 0),
+		bar("2019/05/10", 90, 93, 89, 92, 0),
+		bar("2019/05/13", 94, 97, 93, 96, 0),
+	}
+	// 実体が上にあって下ヒゲの長い足
+	umbrella := bar("2019/05/14", 100, 101.2, 96, 101, 0)
+
+	tests := []struct {
+		name string
+		bars []ohlc
+		want []string
+	}{
+		{
+			name: "doji",
+			bars: []ohlc{bar("2019/05/14", 100, 105, 95, 100.5, 0)},
+			want: []string{doji},
+		},
+		{
+			name: "hammer after downtrend",
+			bars: append(append([]ohlc{}, downtrend...), umbrella),
+			want: []string{hammer},
+		},
+		{
+			name: "hanging man after uptrend",
+			bars: append(append([]ohlc{}, uptrend...), umbrella),
+			want: []string{hangingMan},
+		},
+		{
+			name: "umbrella without enough days",
+			bars: []ohlc{umbrella},
+			want: nil,
+		},
+		{
+			name: "doji and hammer",
+			bars: append(append([]ohlc{}, downtrend...), bar("2019/05/14", 100, 100.1, 96, 100.1, 0)),
+			want: []string{doji, hammer},
+		},
+		{
+			name: "bullish engulfing",
+			bars: []ohlc{
+				bar("2019/05/13", 105, 106, 99, 100, 0),
+				bar("2019/05/14", 99, 108, 98, 107, 0),
+			},
+			want: []string{bullishEngulfing},
+		},
+		{
+			name: "bearish engulfing",
+			bars: []ohlc{
+				bar("2019/05/13", 100, 106, 99, 105, 0),
+				bar("2019/05/14", 106, 107, 97, 98, 0),
+			},
+			want: []string{bearishEngulfing},
+		},
+		{
+			name: "same direction is not engulfing",
+			bars: []ohlc{
+				bar("2019/05/13", 101, 106, 99, 105, 0),
+				bar("2019/05/14", 100, 108, 98, 107, 0),
+			},
+			want: nil,
+		},
+		{
+			name: "morning star",
+			bars: []ohlc{
+				bar("2019/05/10", 110, 111, 99, 100, 0),
+				bar("2019/05/13", 98, 99, 96, 97.5, 0),
+				bar("2019/05/14", 99, 109, 98, 108, 0),
+			},
+			want: []string{morningStar},
+		},
+		{
+			name: "morning star not recovering half of the first body",
+			bars: []ohlc{
+				bar("2019/05/10", 110, 111, 99, 100, 0),
+				bar("2019/05/13", 98, 99, 96, 97.5, 0),
+				bar("2019/05/14", 99, 105, 98, 104, 0),
+			},
+			want: nil,
+		},
+		{
+			name: "evening star",
+			bars: []ohlc{
+				bar("2019/05/10", 100, 111, 99, 110, 0),
+				bar("2019/05/13", 112, 114, 111, 112.5, 0),
+				bar("2019/05/14", 111, 112, 101, 102, 0),
+			},
+			want: []string{eveningStar},
+		},
+		{
+			name: "three white soldiers",
+			bars: []ohlc{
+				bar("2019/05/10", 100, 106, 99, 105, 0),
+				bar("2019/05/13", 103, 110, 102, 109, 0),
+				bar("2019/05/14", 107, 114, 106, 113, 0),
+			},
+			want: []string{threeWhiteSoldiers},
+		},
+		{
+			name: "three white soldiers with a gap up open",
+			bars: []ohlc{
+				bar("2019/05/10", 100, 106, 99, 105, 0),
+				bar("2019/05/13", 107, 110, 106, 109, 0),
+				bar("2019/05/14", 108, 114, 107, 113, 0),
+			},
+			want: nil,
+		},
+		{
+			name: "no range",
+			bars: []ohlc{bar("2019/05/14", 100, 100, 100, 100, 0)},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		got := candlePatterns(tt.bars, len(tt.bars)-1)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: candlePatterns() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCalcCandleRecords(t *testing.T) {
+	bars := []ohlc{
+		bar("2019/05/07", 122, 123, 119, 120, 0),
+		bar("2019/05/08", 118, 119, 115, 116, 0),
+		bar("2019/05/09", 114, 115, 111, 112, 0),
+		bar("2019/05/10", 110, 111, 107, 108, 0),
+		bar("2019/05/13", 106, 107, 103, 104, 0),
+		bar("2019/05/14", 100, 101.2, 96, 101, 0),
+		bar("2019/05/15", 101, 103, 99, 102.5, 0),
+	}
+	// トレンドを見る日数より前の日は保存せず、パターンのない日も空で保存する
+	want := [][]string{
+		{"1802", "2019/05/14", hammer},
+		{"1802", "2019/05/15", ""},
+	}
+	if got := calcCandleRecords("1802", bars); !reflect.DeepEqual(got, want) {
+		t.Errorf("calcCandleRecords() = %v, want %v", got, want)
+	}
+	if got := calcCandleRecords("1802", bars[:candleTrendDays]); len(got) != 0 {
+		t.Errorf("calcCandleRecords() with short bars = %v, want none", got)
+	}
+}
@@ -0,0 +1,127 @@
+// 移動平均線どうしのゴールデンクロス、デッドクロスの判定をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// 何営業日前までのクロスを探すか
+const crossLookbackDays = 20
+
+// 2: deadCross : 短期線が長期線を上から下に抜けた
+// 1: goldenCross : 短期線が長期線を下から上に抜けた
+// 0: noCross : crossLookbackDays以内にクロスなし
+type crossKind int
+
+const (
+	noCross crossKind = iota
+	goldenCross
+	deadCross
+)
+
+// constのString変換メソッド
+func (c crossKind) String() string {
+	return [3]string{"none", "golden", "dead"}[c]
+}
+
+// Stringの逆変換
+func parseCrossKind(s string) (crossKind, error) {
+	for _, c := range []crossKind{noCross, goldenCross, deadCross} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return noCross, fmt.Errorf("unknown crossKind: '%s'", s)
+}
+
+// 判定対象の短期線と長期線の組
+// crossesテーブルとcrossInfoの項目はcrossPairsの順番に対応させる
+type crossPair struct {
+	Short int
+	Long  int
+}
+
+var crossPairs = []crossPair{{5, 25}, {25, 75}}
+
+// 移動平均線の組ごとの直近のクロスとそれが何営業日前か
+// クロスがない場合はDaysAgoは-1
+type crossInfo struct {
+	Cross5x25         crossKind
+	Cross5x25DaysAgo  int
+	Cross25x75        crossKind
+	Cross25x75DaysAgo int
+}
+
+// 古い順に並べた短期線と長期線から、位置iの日付の時点で直近のクロスとそれが何営業日前かを返す
+// 長期線の日数分のデータがそろっていない期間のクロスは無視する
+func lastCross(short []float64, long []float64, i int, longDays int) (crossKind, int) {
+	for j := i; j > i-crossLookbackDays && j >= longDays; j-- {
+		prev := short[j-1] - long[j-1]
+		cur := short[j] - long[j]
+		if prev <= 0 && cur > 0 {
+			return goldenCross, i - j
+		}
+		if prev >= 0 && cur < 0 {
+			return deadCross, i - j
+		}
+	}
+	return noCross, -1
+}
+
+// 古い順に並べた四本値からcrossesテーブルのレコードを作る
+// crossPairsの順に、クロスの種類と何営業日前かを並べる
+func calcCrossRecords(code string, bars []ohlc) [][]string {
+	closes := closesOf(bars)
+	movingMap := make(map[int][]float64)
+	for _, p := range crossPairs {
+		for _, d := range []int{p.Short, p.Long} {
+			if _, ok := movingMap[d]; !ok {
+				movingMap[d] = sma(closes, d)
+			}
+		}
+	}
+
+	var records [][]string
+	// 一番長い75日線がそろってから保存する
+	for i := storeStart(len(bars), 75); i < len(bars); i++ {
+		record := []string{code, bars[i].Date}
+		for _, p := range crossPairs {
+			kind, daysAgo := lastCross(movingMap[p.Short], movingMap[p.Long], i, p.Long)
+			record = append(record, kind.String(), strconv.Itoa(daysAgo))
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// 取得できなかった場合のcrossInfo
+// DaysAgoが0だと当日にクロスしたことになってしまうので、クロスなしと同じ-1にする
+var emptyCrossInfo = crossInfo{noCross, -1, noCross, -1}
+
+// 銘柄コード、日付を渡すと該当のcrossInfo structに対応するクロスの情報を返す
+// 取得できなかった場合はemptyCrossInfoを返す
+func getCrossInfo(r *http.Request, db *sql.DB, code string, date string) (crossInfo, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT cross5x25, days5x25, cross25x75, days25x75 FROM crosses WHERE code = %s and date = '%s';", code, date))
+	if err != nil {
+		return emptyCrossInfo, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(ret) != 4 {
+		return emptyCrossInfo, fmt.Errorf("no selected data")
+	}
+
+	var kinds [2]crossKind
+	var days [2]int
+	for i := 0; i < 2; i++ {
+		if kinds[i], err = parseCrossKind(ret[i*2]); err != nil {
+			return emptyCrossInfo, err
+		}
+		if days[i], err = strconv.Atoi(ret[i*2+1]); err != nil {
+			return emptyCrossInfo, fmt.Errorf("failed to Atoi %v", err)
+		}
+	}
+	return crossInfo{kinds[0], days[0], kinds[1], days[1]}, nil
+}
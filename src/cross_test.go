@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestLastCross(t *testing.T) {
+	tests := []struct {
+		name     string
+		short    []float64
+		long     []float64
+		i        int
+		longDays int
+		kind     crossKind
+		daysAgo  int
+	}{
+		{"golden cross yesterday", []float64{1, 1, 1, 3, 3}, []float64{2, 2, 2, 2, 2}, 4, 1, goldenCross, 1},
+		{"dead cross today", []float64{3, 3, 3, 3, 1}, []float64{2, 2, 2, 2, 2}, 4, 1, deadCross, 0},
+		{"touch then cross", []float64{1, 2, 3, 3, 3}, []float64{2, 2, 2, 2, 2}, 4, 1, goldenCross, 2},
+		{"no cross", []float64{3, 3, 3, 3, 3}, []float64{2, 2, 2, 2, 2}, 4, 1, noCross, -1},
+		// 長期線がそろっていない期間のクロスは無視する
+		{"cross before long line is ready", []float64{1, 1, 1, 3, 3}, []float64{2, 2, 2, 2, 2}, 4, 4, noCross, -1},
+		{"latest cross wins", []float64{3, 1, 3, 1, 1}, []float64{2, 2, 2, 2, 2}, 4, 1, deadCross, 1},
+	}
+	for _, tt := range tests {
+		kind, daysAgo := lastCross(tt.short, tt.long, tt.i, tt.longDays)
+		if kind != tt.kind || daysAgo != tt.daysAgo {
+			t.Errorf("%s: lastCross() = %v, %d, want %v, %d", tt.name, kind, daysAgo, tt.kind, tt.daysAgo)
+		}
+	}
+
+	// crossLookbackDaysより前のクロスは探さない
+	n := crossLookbackDays + 5
+	short, long := make([]float64, n), make([]float64, n)
+	for i := range short {
+		short[i], long[i] = 3, 2
+	}
+	short[0] = 1
+	if kind, daysAgo := lastCross(short, long, n-1, 1); kind != noCross || daysAgo != -1 {
+		t.Errorf("old cross: lastCross() = %v, %d, want none, -1", kind, daysAgo)
+	}
+}
@@ -2,58 +2,111 @@
 package main
 
 import (
-	"fmt"
-	//"net/http"
-	//"os"
+	"database/sql"
+	"net/http"
 	"time"
-	//"google.golang.org/appengine" // Required external App Engine library
-	//"google.golang.org/appengine/log"
+
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
 )
 
-/*
-// 与えられた日付の前日が取引日かどうかを判定する関数
-// 実行時の日付time.Now().In(jst)と休日一覧Mapを渡す
-func isPreviousBussinessday(r *http.Request, t time.Time, holidayMap map[string]bool) bool {
-	ctx := appengine.NewContext(r)
+// 取引日の計算をする取引所のカレンダー
+// 土日と休日一覧Mapにある日付以外を取引日とする
+type tradingCalendar struct {
+	Name     string          // 取引所の名前. JPX, NYSEなど
+	Location *time.Location  // 取引所のタイムゾーン
+	holidays map[string]bool // {"2019/01/01", true}のような休日一覧Map
+}
 
-	if ENV == "test" {
-		// test環境は常にtrue
-		return true
-	}
+// 取引所の名前とタイムゾーン、休日一覧Mapから取引所のカレンダーを作る
+func newTradingCalendar(name string, loc *time.Location, holidayMap map[string]bool) *tradingCalendar {
+	return &tradingCalendar{Name: name, Location: loc, holidays: holidayMap}
+}
+
+// 規則から求めたJPXの休業日とholidaysテーブルまたはholidayシートの上書きからJPXのカレンダーを作る
+func getTradingCalendar(r *http.Request, srv *sheets.Service, db *sql.DB) *tradingCalendar {
+	return newTradingCalendar(jpx, loadLocation(r, "Asia/Tokyo"), getHolidays(r, srv, db, jpx))
+}
 
-	// 以下はprodの場合
-	log.Infof(ctx, "received date: %v", t)
-	// 直近の営業日を取得
-	previousBussinessDay, err := getPreviousBussinessDay(t, holidayMap)
+// タイムゾーンを読み込む. 読み込めない環境ではUTCにする
+// UTCにすると取引日の判定が日付をまたいでずれるので、ログに残す
+func loadLocation(r *http.Request, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
 	if err != nil {
-		log.Errorf(ctx, "failed to getPreviousBussinessDay. %v", err)
-		os.Exit(0)
+		log.Warningf(appengine.NewContext(r), "failed to load location %s. use UTC. %v", name, err)
+		return time.UTC
 	}
-	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
+	return loc
+}
 
-	previousTime, _ := time.Parse("2006/01/02", previousBussinessDay)
-	previousTimeNextDay := previousTime.AddDate(0, 0, 1)
-	if t.Format("2006/01/02") == previousTimeNextDay.Format("2006/01/02") {
-		log.Infof(ctx, "previous day is BussinessDay.")
-		return true
+// 取引所のタイムゾーンでの現在時刻
+func (c *tradingCalendar) Now() time.Time {
+	return time.Now().In(c.Location)
+}
+
+// 取引日かどうか
+func (c *tradingCalendar) IsTradingDay(t time.Time) bool {
+	return !isSaturdayOrSunday(t) && !c.holidays[t.Format("2006/01/02")]
+}
+
+// 取引所のタイムゾーンで見た前の日が取引日だったか
+// 前の日が休みの日だったら取得すべきデータがないので、日次の処理を起動しない判定に使う
+func (c *tradingCalendar) PreviousDayOpen() bool {
+	return c.IsTradingDay(c.Now().AddDate(0, 0, -1))
+}
+
+// tより後の最初の取引日
+func (c *tradingCalendar) Next(t time.Time) time.Time {
+	return c.AddTradingDays(t, 1)
+}
+
+// tより前の直近の取引日
+func (c *tradingCalendar) Prev(t time.Time) time.Time {
+	return c.AddTradingDays(t, -1)
+}
+
+// tからn取引日後(nが負の場合はn取引日前)の日付
+// tが取引日でない場合も、tの次(前)の取引日を1取引日目として数える
+func (c *tradingCalendar) AddTradingDays(t time.Time, n int) time.Time {
+	step := 1
+	if n < 0 {
+		step, n = -1, -n
 	}
-	return false
+	for n > 0 {
+		t = t.AddDate(0, 0, step)
+		if c.IsTradingDay(t) {
+			n--
+		}
+	}
+	return t
+}
+
+// fromより後でto以前の取引日の数
+// toがfromより前の場合は、toより後でfrom以前の取引日の数を負の数で返す
+func (c *tradingCalendar) TradingDaysBetween(from time.Time, to time.Time) int {
+	sign := 1
+	if to.Before(from) {
+		from, to, sign = to, from, -1
+	}
+	n := 0
+	for d := from.AddDate(0, 0, 1); !d.After(to); d = d.AddDate(0, 0, 1) {
+		if c.IsTradingDay(d) {
+			n++
+		}
+	}
+	return n * sign
 }
-*/
 
-// 直近の営業日を取得する関数
-// 実行時の日付time.Now().In(jst)と休日一覧Mapを渡す
-// 東証の休日一覧には土日が入っていないことがあるのでisSaturdayOrSundayで土日でないかも確認する
-func getPreviousBussinessDay(t time.Time, holidayMap map[string]bool) (string, error) {
-	// 無限ループは嫌なので直近30日間見て取引日が見つからなかったらerrorを返す
-	for i := 1; i <= 30; i++ {
-		previousTime := t.AddDate(0, 0, -i)
-		previousDate := previousTime.Format("2006/01/02")
-		if !holidayMap[previousDate] && !isSaturdayOrSunday(previousTime) {
-			return previousDate, nil
+// fromからtoまで(両端を含む)の取引日を古い順に返す
+func (c *tradingCalendar) Range(from time.Time, to time.Time) []time.Time {
+	var days []time.Time
+	for d := from; !d.After(to); d = d.AddDate(0, 0, 1) {
+		if c.IsTradingDay(d) {
+			days = append(days, d)
 		}
 	}
-	return "", fmt.Errorf("there are no previous bussinessdays")
+	return days
 }
 
 func isSaturdayOrSunday(t time.Time) bool {
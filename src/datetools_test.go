@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, _ := time.Parse("2006/01/02", s)
+	return t
+}
+
+func TestAddTradingDays(t *testing.T) {
+	// 2019年のゴールデンウィークは04/27から05/06まで休み
+	cal := newTradingCalendar(jpx, time.UTC, jpxHolidays(2019))
+	tests := []struct {
+		from string
+		n    int
+		want string
+	}{
+		{"2019/04/26", 1, "2019/05/07"},
+		{"2019/05/07", -1, "2019/04/26"},
+		{"2019/05/13", 4, "2019/05/17"},
+		{"2019/05/13", 5, "2019/05/20"},
+		{"2019/05/16", -19, "2019/04/11"},
+		// 取引日でない日からは次(前)の取引日を1取引日目として数える
+		{"2019/05/04", 1, "2019/05/07"},
+		{"2019/05/04", -1, "2019/04/26"},
+		{"2019/05/16", 0, "2019/05/16"},
+	}
+	for _, tt := range tests {
+		if got := cal.AddTradingDays(day(tt.from), tt.n).Format("2006/01/02"); got != tt.want {
+			t.Errorf("AddTradingDays(%s, %d) = %s, want %s", tt.from, tt.n, got, tt.want)
+		}
+	}
+	if got := cal.Next(day("2019/04/26")).Format("2006/01/02"); got != "2019/05/07" {
+		t.Errorf("Next(2019/04/26) = %s, want 2019/05/07", got)
+	}
+	if got := cal.Prev(day("2019/05/07")).Format("2006/01/02"); got != "2019/04/26" {
+		t.Errorf("Prev(2019/05/07) = %s, want 2019/04/26", got)
+	}
+}
+
+func TestTradingDaysBetween(t *testing.T) {
+	cal := newTradingCalendar(jpx, time.UTC, jpxHolidays(2019))
+	tests := []struct {
+		from string
+		to   string
+		want int
+	}{
+		{"2019/04/26", "2019/05/07", 1},
+		{"2019/05/07", "2019/04/26", -1},
+		{"2019/05/13", "2019/05/17", 4},
+		{"2019/05/16", "2019/05/16", 0},
+		// 休みの日の間
+		{"2019/04/27", "2019/05/06", 0},
+		// fromは数えない
+		{"2019/04/01", "2019/04/30", 19},
+	}
+	for _, tt := range tests {
+		if got := cal.TradingDaysBetween(day(tt.from), day(tt.to)); got != tt.want {
+			t.Errorf("TradingDaysBetween(%s, %s) = %d, want %d", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	cal := newTradingCalendar(jpx, time.UTC, jpxHolidays(2019))
+	tests := []struct {
+		from string
+		to   string
+		want []string
+	}{
+		{"2019/04/25", "2019/05/08", []string{"2019/04/25", "2019/04/26", "2019/05/07", "2019/05/08"}},
+		{"2019/05/16", "2019/05/16", []string{"2019/05/16"}},
+		{"2019/04/27", "2019/05/06", nil},
+		{"2019/05/17", "2019/05/13", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, d := range cal.Range(day(tt.from), day(tt.to)) {
+			got = append(got, d.Format("2006/01/02"))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Range(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
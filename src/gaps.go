@@ -0,0 +1,282 @@
+// dailyの欠けている(銘柄, 取引日)を見つけて、必要ならスクレイピングし直して埋める
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// from, toの指定がない場合に調べる直近の取引日数
+const gapDefaultDays = 20
+
+// dailyに欠けている銘柄と取引日
+type gap struct {
+	Code string
+	Date string
+}
+
+// 期間内の全取引日についてdailyの欠けを調べてCSVで返すHandler
+// /gaps?from=2019/05/01&to=2019/05/16&codes=1802,2587&repair=true
+// from, toの指定がなければ直近の取引日までのgapDefaultDays取引日分を調べる
+// 取引日は銘柄の取引所のカレンダーで求める
+// codesの指定がなければichibuシートの全銘柄を調べる
+// 期間内に取引日のない銘柄は調べずに、status列にskippedとしてその理由を返し、残りの銘柄は調べる
+// repair=trueの場合は欠けのある銘柄だけをスクレイピングし直し、欠けていた日以降の移動平均を計算し直す
+// スクレイピングで取得できるのは直近１ヶ月分なので、それより古い欠けは埋められない
+func gapsHandler(w http.ResponseWriter, r *http.Request) {
+	// GAE log
+	ctx := appengine.NewContext(r)
+
+	// get environment var, sheet, db
+	sheet, db, err := initialize(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to initialize. err: %v", err)
+		os.Exit(0)
+	}
+	reg := getCalendarRegistry(r, sheet, db)
+
+	from, err := getDateParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := getDateParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from != "" && to != "" && from > to {
+		http.Error(w, fmt.Sprintf("from %s is after to %s", from, to), http.StatusBadRequest)
+		return
+	}
+	repair := r.FormValue("repair") == "true"
+
+	codes, err := getCodesParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(codes) == 0 {
+		for _, row := range getSheetData(r, sheet, codeSheetID, "ichibu") {
+			if len(row) > 0 {
+				codes = append(codes, fmt.Sprintf("%v", row[0]))
+			}
+		}
+	}
+	if len(codes) == 0 {
+		log.Errorf(ctx, "no target codes")
+		http.Error(w, "no target codes", http.StatusInternalServerError)
+		return
+	}
+
+	// 銘柄ごとに取引所のカレンダーで調べる取引日を求める
+	// 書き込む前に全ての銘柄について求めておき、取引日のない銘柄は除いて残りの銘柄を調べる
+	codeDays := make(map[string][]time.Time)
+	var targets []string
+	skipped := make(map[string]string)
+	for _, code := range codes {
+		cal := reg.ForCode(code)
+		// test環境ではデータの存在する最新の日付に合わせる
+		codeTo := to
+		if codeTo == "" {
+			codeTo = "2019/05/16"
+			if runEnv != "test" {
+				codeTo = reg.PreviousBussinessDay(code)
+			}
+		}
+		t, _ := time.Parse("2006/01/02", codeTo)
+		f := cal.AddTradingDays(t, -(gapDefaultDays - 1))
+		if from != "" {
+			f, _ = time.Parse("2006/01/02", from)
+		}
+		days := cal.Range(f, t)
+		if len(days) == 0 {
+			skipped[code] = fmt.Sprintf("no trading days between %s and %s", f.Format("2006/01/02"), codeTo)
+			log.Warningf(ctx, "skip code %s. %s", code, skipped[code])
+			continue
+		}
+		codeDays[code] = days
+		targets = append(targets, code)
+	}
+	if len(targets) == 0 {
+		http.Error(w, fmt.Sprintf("no trading days for any codes. codes: %d", len(codes)), http.StatusBadRequest)
+		return
+	}
+
+	gaps, err := findGaps(r, db, targets, codeDays)
+	if err != nil {
+		log.Errorf(ctx, "failed to findGaps. %v", err)
+		http.Error(w, "failed to find gaps", http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "found %d gaps. codes: %d, skipped: %d", len(gaps), len(targets), len(skipped))
+
+	if repair && len(gaps) > 0 {
+		if err := repairGaps(r, db, reg, gaps); err != nil {
+			log.Errorf(ctx, "failed to repairGaps. %v", err)
+		}
+		// 埋められなかった欠けを返す
+		if gaps, err = findGaps(r, db, targets, codeDays); err != nil {
+			log.Errorf(ctx, "failed to findGaps. %v", err)
+			http.Error(w, "failed to find gaps", http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "%d gaps remain after repair", len(gaps))
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"code", "date", "status"})
+	for _, g := range gaps {
+		cw.Write([]string{g.Code, g.Date, "missing"})
+	}
+	for _, code := range codes {
+		if reason, ok := skipped[code]; ok {
+			cw.Write([]string{code, "", "skipped: " + reason})
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Errorf(ctx, "failed to write csv. %v", err)
+	}
+}
+
+// 銘柄と銘柄ごとに古い順に並べた取引日からdailyの欠けを銘柄、日付の順に返す
+// 上場前など、その銘柄のdailyの最初の日付より前の日は欠けとしない
+func findGaps(r *http.Request, db *sql.DB, codes []string, codeDays map[string][]time.Time) ([]gap, error) {
+	// 全ての銘柄の取引日を含む期間をまとめて取得する
+	var from, to string
+	for _, days := range codeDays {
+		f, t := days[0].Format("2006/01/02"), days[len(days)-1].Format("2006/01/02")
+		if from == "" || f < from {
+			from = f
+		}
+		if to == "" || t > to {
+			to = t
+		}
+	}
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT code, date FROM daily WHERE date >= '%s' AND date <= '%s';", from, to))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+	exists := make(map[gap]bool)
+	for i := 0; i+1 < len(ret); i += 2 {
+		exists[gap{ret[i], ret[i+1]}] = true
+	}
+
+	ret, err = selectTable(r, db, "SELECT code, MIN(date) FROM daily GROUP BY code;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+	firstDates := make(map[string]string)
+	for i := 0; i+1 < len(ret); i += 2 {
+		firstDates[ret[i]] = ret[i+1]
+	}
+
+	var gaps []gap
+	for _, code := range codes {
+		for _, d := range codeDays[code] {
+			date := d.Format("2006/01/02")
+			// dailyに一件もない銘柄は全ての日を欠けとする
+			if first, ok := firstDates[code]; ok && date < first {
+				continue
+			}
+			if !exists[gap{code, date}] {
+				gaps = append(gaps, gap{code, date})
+			}
+		}
+	}
+	return gaps, nil
+}
+
+// 欠けのある銘柄だけをスクレイピングし直して欠けていた日のdailyを書き込み、
+// 欠けていた最初の日からdailyの最新の日までの移動平均を計算し直す
+// 書き込めた銘柄はindicatorHandler, timeframeHandlerで保存する範囲の指標、週足、月足も計算し直す
+// それより古い日付の指標は欠けていた日のデータを含まないまま残る
+func repairGaps(r *http.Request, db *sql.DB, reg *calendarRegistry, gaps []gap) error {
+	ctx := appengine.NewContext(r)
+
+	missing := make(map[gap]bool)
+	var codes []string
+	var rows [][]interface{}
+	earliest := gaps[0].Date
+	for _, g := range gaps {
+		missing[g] = true
+		if g.Date < earliest {
+			earliest = g.Date
+		}
+		if len(codes) == 0 || codes[len(codes)-1] != g.Code {
+			codes = append(codes, g.Code)
+			rows = append(rows, []interface{}{g.Code})
+		}
+	}
+
+	// スクレイピングに失敗した銘柄があっても取得できた分は書き込む
+	prices, err := getEachCodesPrices(r, rows)
+	if err != nil {
+		log.Warningf(ctx, "failed to scrape code. %v", err)
+	}
+	var records [][]string
+	var repairedCodes []string
+	for _, p := range prices {
+		// p[0]は銘柄, p[1]は日付
+		if missing[gap{p[0], p[1]}] {
+			records = append(records, p)
+			if len(repairedCodes) == 0 || repairedCodes[len(repairedCodes)-1] != p[0] {
+				repairedCodes = append(repairedCodes, p[0])
+			}
+		}
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("no scraped data for %d gaps", len(gaps))
+	}
+	dailyColumns := []string{"code", "date", "open", "high", "low", "close", "turnover", "modified"}
+	ins, err := insertDB(r, db, "daily", dailyColumns, records)
+	if err != nil {
+		return fmt.Errorf("failed to insertDB. %v", err)
+	}
+	log.Infof(ctx, "repaired %d of %d gaps", ins, len(gaps))
+
+	// 欠けていた日より後の移動平均も欠けていた日の終値を含むので計算し直す
+	latest, err := selectTable(r, db, "SELECT MAX(date) FROM daily;")
+	if err != nil || len(latest) == 0 {
+		return fmt.Errorf("failed to select latest date. %v", err)
+	}
+	f, _ := time.Parse("2006/01/02", earliest)
+	t, err := time.Parse("2006/01/02", latest[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse latest date. %v", err)
+	}
+	// 移動平均を計算し直す取引日は銘柄の取引所のカレンダーで求める
+	calCodes := make(map[*tradingCalendar][]string)
+	for _, code := range codes {
+		cal := reg.ForCode(code)
+		calCodes[cal] = append(calCodes[cal], code)
+	}
+	replaced := 0
+	for cal, cs := range calCodes {
+		replaced += replaceMovingAvgs(r, db, cs, cal.Range(f, t))
+	}
+	log.Infof(ctx, "recalculated movingavg. codes: %d, from: %s, to: %s, records: %d", len(codes), earliest, latest[0], replaced)
+
+	// 指標、週足、月足も欠けていた日の四本値を含むので計算し直す
+	derived := 0
+	for _, code := range repairedCodes {
+		n, err := recalcDerivedRecords(r, db, code)
+		if err != nil {
+			log.Errorf(ctx, "failed to recalcDerivedRecords. %v", err)
+			continue
+		}
+		derived += n
+	}
+	log.Infof(ctx, "recalculated indicators and timeframes. codes: %d, records: %d", len(repairedCodes), derived)
+	return nil
+}
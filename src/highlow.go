@@ -0,0 +1,89 @@
+// 52週高値、安値とその更新の判定をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// 52週の取引日数
+const weeks52Days = 250
+
+// 52週高値、安値とそこからの距離
+type highLowInfo struct {
+	High52w  float64 // 直近52週の高値
+	Low52w   float64 // 直近52週の安値
+	FromHigh float64 // 52週高値に対する終値の距離(%). 0以下
+	FromLow  float64 // 52週安値に対する終値の距離(%). 0以上
+	NewHigh  bool    // その日の高値がそれまでの52週高値を更新したか
+	NewLow   bool    // その日の安値がそれまでの52週安値を更新したか
+}
+
+// 古い順に並べた四本値の位置iの前日までperiod-1日間の高値と安値を返す
+func priorHighLow(bars []ohlc, i int, period int) (float64, float64) {
+	begin := i - period + 1
+	if begin < 0 {
+		begin = 0
+	}
+	high, low := bars[begin].High, bars[begin].Low
+	for j := begin + 1; j < i; j++ {
+		if bars[j].High > high {
+			high = bars[j].High
+		}
+		if bars[j].Low < low {
+			low = bars[j].Low
+		}
+	}
+	return high, low
+}
+
+// 古い順に並べた四本値からhighlowsテーブルのレコードを作る
+// 52週分のデータがそろってから保存する
+func calcHighLowRecords(code string, bars []ohlc) [][]string {
+	var records [][]string
+	for i := storeStart(len(bars), weeks52Days); i < len(bars); i++ {
+		b := bars[i]
+		prevHigh, prevLow := priorHighLow(bars, i, weeks52Days)
+		high, low := prevHigh, prevLow
+		newHigh, newLow := "0", "0"
+		if b.High > prevHigh {
+			high, newHigh = b.High, "1"
+		}
+		if b.Low < prevLow {
+			low, newLow = b.Low, "1"
+		}
+		var fromHigh, fromLow float64
+		if high != 0 {
+			fromHigh = (b.Close - high) / high * 100
+		}
+		if low != 0 {
+			fromLow = (b.Close - low) / low * 100
+		}
+		records = append(records, []string{code, b.Date,
+			fmt.Sprintf("%f", high), fmt.Sprintf("%f", low), fmt.Sprintf("%f", fromHigh), fmt.Sprintf("%f", fromLow),
+			newHigh, newLow})
+	}
+	return records
+}
+
+// 銘柄コード、日付を渡すと該当のhighLowInfo structに対応する52週高値、安値を返す
+func getHighLowInfo(r *http.Request, db *sql.DB, code string, date string) (highLowInfo, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT high52w, low52w, fromhigh, fromlow, newhigh, newlow FROM highlows WHERE code = %s and date = '%s';", code, date))
+	if err != nil {
+		return highLowInfo{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(ret) != 6 {
+		return highLowInfo{}, fmt.Errorf("no selected data")
+	}
+
+	var fs [4]float64
+	for i := range fs {
+		if fs[i], err = strconv.ParseFloat(ret[i], 64); err != nil {
+			return highLowInfo{}, fmt.Errorf("failed to ParseFloat %v", err)
+		}
+	}
+	return highLowInfo{fs[0], fs[1], fs[2], fs[3], ret[4] == "1", ret[5] == "1"}, nil
+}
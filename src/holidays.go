@@ -0,0 +1,344 @@
+// 取引所の休業日カレンダー(JPXの営業日カレンダーのHTMLまたはICSファイル)を読み込んでholidaysテーブルに書き込む
+// holidaysテーブルがあれば、holidayシートの代わりに規則で求めた休業日の上書きとして使う
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+	"google.golang.org/appengine/user"
+)
+
+// holidaysテーブルの項目名
+// closedは休業日なら1, 規則では休業日だが取引日なら0
+var holidayColumns = []string{"exchange", "date", "name", "closed"}
+
+// 取引所ごとの休業日の規則と、上書きに使うHOLIDAY_SHEETIDのシート名
+// optionalのシートはなくてもよい
+var exchangeHolidays = map[string]struct {
+	rules    func(year int) map[string]bool
+	sheet    string
+	optional bool
+}{
+	jpx:  {jpxHolidays, "holiday", false},
+	nyse: {nyseHolidays, "holiday_nyse", true},
+}
+
+// 読み込んだ休業日
+type importedHoliday struct {
+	Date string // 「2019/01/01」の形式
+	Name string // 元日など
+}
+
+// fileで読み込めるのはアプリと一緒にデプロイしたこのディレクトリの中のファイルだけ
+const holidayFileDir = "testdata"
+
+// urlで読み込めるのはJPXのサイトだけ
+const holidayURLHost = "jpx.co.jp"
+
+// 「2019/01/01」「2019年1月1日」などの日付
+var holidayDatePattern = regexp.MustCompile(`(\d{4})\s*[/年.-]\s*(\d{1,2})\s*[/月.-]\s*(\d{1,2})`)
+
+// 休業日カレンダーを読み込んでholidaysテーブルに書き込むHandler
+// /import_holidays?file=testdata/jpx_calendar.html
+// /import_holidays?url=https://www.jpx.co.jp/corporate/about-jpx/calendar/index.html
+// /import_holidays?file=testdata/nyse.ics&exchange=NYSE
+// ファイルの中身が「BEGIN:VCALENDAR」で始まる場合はICS、それ以外はJPXの営業日カレンダーのHTMLとして読む
+// 読み込んだ最初の日から最後の日までは、規則では休業日だがカレンダーにない日を取引日として書き込む
+// 休業日を書き換えられるので、cronか管理者のログインからしか実行できない
+func importHolidaysHandler(w http.ResponseWriter, r *http.Request) {
+	// GAE log
+	ctx := appengine.NewContext(r)
+
+	// X-Appengine-Cronヘッダは外部からのリクエストではApp Engineが取り除く
+	if r.Header.Get("X-Appengine-Cron") != "true" && !user.IsAdmin(ctx) {
+		log.Warningf(ctx, "forbidden request to import holidays")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// get environment var, sheet, db
+	_, db, err := initialize(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to initialize. err: %v", err)
+		os.Exit(0)
+	}
+
+	exchange := strings.ToUpper(r.FormValue("exchange"))
+	if exchange == "" {
+		exchange = jpx
+	}
+	eh, ok := exchangeHolidays[exchange]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown exchange: %s", exchange), http.StatusBadRequest)
+		return
+	}
+
+	body, err := readHolidaySource(r, r.FormValue("file"), r.FormValue("url"))
+	if err != nil {
+		log.Errorf(ctx, "failed to readHolidaySource. %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var holidays []importedHoliday
+	if strings.HasPrefix(strings.TrimSpace(body), "BEGIN:VCALENDAR") {
+		holidays, err = parseICSHolidays(body)
+	} else {
+		holidays, err = parseJPXCalendarHTML(body)
+	}
+	if err != nil {
+		log.Errorf(ctx, "failed to parse holidays. %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(holidays) == 0 {
+		log.Errorf(ctx, "no holidays in source")
+		http.Error(w, "no holidays in source", http.StatusBadRequest)
+		return
+	}
+
+	records := holidayRecords(exchange, holidays, eh.rules)
+	ins, err := replaceDB(r, db, "holidays", holidayColumns, records)
+	if err != nil {
+		log.Errorf(ctx, "failed to replaceDB. %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "imported %d holidays. exchange: %s, records: %d", len(holidays), exchange, ins)
+	fmt.Fprintf(w, "imported %d holidays. exchange: %s, records: %d\n", len(holidays), exchange, ins)
+}
+
+// アプリと一緒にデプロイしたholidayFileDirの中のファイル、またはJPXのサイトのURLから休業日カレンダーを読み込む
+func readHolidaySource(r *http.Request, file string, rawurl string) (string, error) {
+	var rd io.Reader
+	switch {
+	case file != "":
+		path := filepath.Clean(file)
+		if filepath.IsAbs(path) || filepath.Dir(path) != holidayFileDir {
+			return "", fmt.Errorf("file must be in %s directory: '%s'", holidayFileDir, file)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to open file. %v", err)
+		}
+		defer f.Close()
+		rd = f
+	case rawurl != "":
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse url. %v", err)
+		}
+		host := u.Hostname()
+		if u.Scheme != "https" || (host != holidayURLHost && !strings.HasSuffix(host, "."+holidayURLHost)) {
+			return "", fmt.Errorf("url must be https://%s: '%s'", holidayURLHost, rawurl)
+		}
+		ctx, cancel := context.WithTimeout(appengine.NewContext(r), 30*time.Second)
+		defer cancel()
+		res, err := urlfetch.Client(ctx).Get(u.String())
+		if err != nil {
+			return "", fmt.Errorf("failed to get resp. url: '%s', err: %v", rawurl, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			return "", fmt.Errorf("status code is error. statuscode: %d, url: '%s'", res.StatusCode, rawurl)
+		}
+		rd = res.Body
+	default:
+		return "", fmt.Errorf("file or url is required")
+	}
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return "", fmt.Errorf("failed to read. %v", err)
+	}
+	return string(b), nil
+}
+
+// JPXの営業日カレンダーのページから休業日を読み取る
+// 表の各行の一つ目のセルが日付、二つ目のセルが休業日の名前になっていることを想定している
+func parseJPXCalendarHTML(body string) ([]importedHoliday, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse html. %v", err)
+	}
+	var holidays []importedHoliday
+	doc.Find("table tr").Each(func(i int, s *goquery.Selection) {
+		cells := s.Find("td, th")
+		if cells.Length() == 0 {
+			return
+		}
+		date, ok := normalizeHolidayDate(cells.Eq(0).Text())
+		if !ok {
+			return
+		}
+		name := ""
+		if cells.Length() >= 2 {
+			name = strings.TrimSpace(cells.Eq(1).Text())
+		}
+		holidays = append(holidays, importedHoliday{Date: date, Name: name})
+	})
+	return holidays, nil
+}
+
+// ICSファイルのVEVENTを休業日として読み取る
+// DTENDは終了日を含まないので、DTSTARTからDTENDの前日までを休業日とする
+func parseICSHolidays(body string) ([]importedHoliday, error) {
+	// 空白で始まる行は前の行の続き
+	var lines []string
+	sc := bufio.NewScanner(strings.NewReader(body))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan ics. %v", err)
+	}
+
+	var holidays []importedHoliday
+	var start, end time.Time
+	var name string
+	for _, line := range lines {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		// 「DTSTART;VALUE=DATE:20190101」のようにパラメータが付くことがある
+		key, value := strings.SplitN(line[:i], ";", 2)[0], line[i+1:]
+		switch key {
+		case "BEGIN":
+			if value == "VEVENT" {
+				start, end, name = time.Time{}, time.Time{}, ""
+			}
+		case "DTSTART", "DTEND":
+			if len(value) < 8 {
+				return nil, fmt.Errorf("invalid %s: %s", key, value)
+			}
+			t, err := time.Parse("20060102", value[:8])
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s. %v", key, err)
+			}
+			if key == "DTSTART" {
+				start = t
+			} else {
+				end = t
+			}
+		case "SUMMARY":
+			name = strings.Replace(value, `\,`, ",", -1)
+		case "END":
+			if value != "VEVENT" || start.IsZero() {
+				continue
+			}
+			if !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			for d := start; d.Before(end); d = d.AddDate(0, 0, 1) {
+				holidays = append(holidays, importedHoliday{Date: d.Format("2006/01/02"), Name: name})
+			}
+		}
+	}
+	return holidays, nil
+}
+
+// 「2019/01/01（火）」「2019年1月1日」などを「2019/01/01」の形式にする
+func normalizeHolidayDate(s string) (string, bool) {
+	m := holidayDatePattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	y, _ := strconv.Atoi(m[1])
+	mo, _ := strconv.Atoi(m[2])
+	d, _ := strconv.Atoi(m[3])
+	t := time.Date(y, time.Month(mo), d, 0, 0, 0, 0, time.UTC)
+	// 2019/02/30のような存在しない日付は除く
+	if t.Month() != time.Month(mo) || t.Day() != d {
+		return "", false
+	}
+	return t.Format("2006/01/02"), true
+}
+
+// 読み込んだ休業日からholidaysテーブルのレコードを作る
+// 読み込んだ最初の日から最後の日までの規則による休業日のうち、カレンダーにない日は取引日(closedが0)とする
+// 一年の途中までしかないカレンダーで、その先の休業日を取引日にしないように期間の外は書き込まない
+// 土日はもともと休みなので書き込まない
+func holidayRecords(exchange string, holidays []importedHoliday, rules func(year int) map[string]bool) [][]string {
+	imported := make(map[string]string)
+	years := make(map[int]bool)
+	var first, last string
+	for _, h := range holidays {
+		t, err := time.Parse("2006/01/02", h.Date)
+		if err != nil || isSaturdayOrSunday(t) {
+			continue
+		}
+		// SQLの文字列を壊さないように引用符を除く
+		imported[h.Date] = strings.NewReplacer("'", "", `\`, "").Replace(h.Name)
+		years[t.Year()] = true
+		if first == "" || h.Date < first {
+			first = h.Date
+		}
+		if last == "" || h.Date > last {
+			last = h.Date
+		}
+	}
+
+	var records [][]string
+	for date, name := range imported {
+		records = append(records, []string{exchange, date, name, "1"})
+	}
+	for y := range years {
+		for date := range rules(y) {
+			t, _ := time.Parse("2006/01/02", date)
+			if date < first || date > last {
+				continue
+			}
+			if _, ok := imported[date]; !ok && !isSaturdayOrSunday(t) {
+				records = append(records, []string{exchange, date, "", "0"})
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i][1] < records[j][1]
+	})
+	return records
+}
+
+// 規則で求めた休業日の上書きを{"2019/01/01", true}のようなMapで返す
+// holidaysテーブルにその取引所の休業日があればそれを使い、なければholidayシートから読み取る
+// dbはHandlerで接続したものを使う. DBを使わないHandlerではnilを渡してholidayシートから読み取る
+func getHolidayOverrides(r *http.Request, srv *sheets.Service, db *sql.DB, exchange string) map[string]bool {
+	ctx := appengine.NewContext(r)
+
+	eh := exchangeHolidays[exchange]
+	if db == nil {
+		return getHolidaysFromSheet(r, srv, eh.sheet, eh.optional)
+	}
+	ret, err := selectTable(r, db, fmt.Sprintf("SELECT date, closed FROM holidays WHERE exchange = '%s';", exchange))
+	if err != nil || len(ret) == 0 {
+		log.Infof(ctx, "no holidays in db. use %s sheet. exchange: %s, err: %v", eh.sheet, exchange, err)
+		return getHolidaysFromSheet(r, srv, eh.sheet, eh.optional)
+	}
+	holidayMap := make(map[string]bool)
+	for i := 0; i+1 < len(ret); i += 2 {
+		holidayMap[ret[i]] = ret[i+1] == "1"
+	}
+	return holidayMap
+}
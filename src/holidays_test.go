@@ -0,0 +1,179 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testdataの休業日カレンダーはテスト用に一部の日付だけを書いたもの
+// /import_holidaysで読み込むと期間内の他の休業日を取引日にしてしまうので読み込まない
+func readTestdata(t *testing.T, name string) string {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("failed to read testdata. %v", err)
+	}
+	return string(b)
+}
+
+func TestParseICSHolidays(t *testing.T) {
+	// 折り返した行、エスケープした「,」、DTENDのない日、日時のDTSTART、複数日の休業日
+	// DTSTARTのないVEVENTと「:」のない行は読み飛ばす
+	got, err := parseICSHolidays(readTestdata(t, "nyse_holidays_test.ics"))
+	if err != nil {
+		t.Fatalf("parseICSHolidays() error: %v", err)
+	}
+	want := []importedHoliday{
+		{"2019/01/01", "New Year's Day"},
+		{"2019/04/19", "Good Friday"},
+		{"2019/12/25", "Markets closed, Christmas Day"},
+		{"2018/12/05", "National Day of Mourning"},
+		{"2001/09/11", "September 11"},
+		{"2001/09/12", "September 11"},
+		{"2001/09/13", "September 11"},
+		{"2001/09/14", "September 11"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseICSHolidays() = %v, want %v", got, want)
+	}
+}
+
+func TestParseICSHolidaysError(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"short DTSTART", "DTSTART;VALUE=DATE:2019", "invalid DTSTART"},
+		{"not a date DTSTART", "DTSTART:2019AB01", "failed to parse DTSTART"},
+		{"not a date DTEND", "DTEND;VALUE=DATE:20191332", "failed to parse DTEND"},
+		{"empty DTSTART", "DTSTART:", "invalid DTSTART"},
+	}
+	for _, tt := range tests {
+		body := strings.Join([]string{"BEGIN:VCALENDAR", "BEGIN:VEVENT", "DTSTART:20190101", tt.line, "SUMMARY:x", "END:VEVENT", "END:VCALENDAR"}, "\r\n")
+		_, err := parseICSHolidays(body)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parseICSHolidays() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// VEVENTがなければ休業日もない
+	if got, err := parseICSHolidays("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n"); err != nil || len(got) != 0 {
+		t.Errorf("parseICSHolidays() with no events = %v, %v, want none", got, err)
+	}
+}
+
+func TestParseJPXCalendarHTML(t *testing.T) {
+	// 見出しの行、存在しない日付、日付でないセル、空の行は読み飛ばし、表の外の日付は読まない
+	got, err := parseJPXCalendarHTML(readTestdata(t, "jpx_calendar_test.html"))
+	if err != nil {
+		t.Fatalf("parseJPXCalendarHTML() error: %v", err)
+	}
+	want := []importedHoliday{
+		{"2019/12/31", "休業日"},
+		{"2020/01/01", "元日"},
+		{"2020/01/02", "休業日"},
+		{"2020/01/03", "休業日"},
+		{"2020/01/13", "成人の日"},
+		{"2020/02/11", ""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseJPXCalendarHTML() = %v, want %v", got, want)
+	}
+
+	if got, err := parseJPXCalendarHTML("<html><body><p>2019/01/01</p></body></html>"); err != nil || len(got) != 0 {
+		t.Errorf("parseJPXCalendarHTML() without table = %v, %v, want none", got, err)
+	}
+}
+
+func TestNormalizeHolidayDate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"2019/01/01（火）", "2019/01/01", true},
+		{"2019年1月1日", "2019/01/01", true},
+		{"2019年 5月 6日（月・振替休日）", "2019/05/06", true},
+		{"2019-1-14", "2019/01/14", true},
+		{"2019.12.31", "2019/12/31", true},
+		{" 2020/2/29 ", "2020/02/29", true},
+		{"2019/02/29", "", false},
+		{"2019/02/30", "", false},
+		{"2019/13/01", "", false},
+		{"2019/00/10", "", false},
+		{"2019/04/31", "", false},
+		{"19/01/01", "", false},
+		{"休業日", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeHolidayDate(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeHolidayDate(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHolidayRecords(t *testing.T) {
+	// 2020/01/13(成人の日)はカレンダーにないので取引日として書き込む
+	// 土曜日と読めない日付は書き込まず、名前の引用符は除く
+	// 2019/11/04, 2020/02/24のような期間の外の規則による休業日は書き込まない
+	holidays := []importedHoliday{
+		{"2019/12/31", "休業日"},
+		{"2020/01/01", "元'日"},
+		{"2020/01/02", ""},
+		{"2020/01/03", `休業\日`},
+		{"2020/01/04", "土曜日"},
+		{"2020/02/11", "建国記念の日"},
+		{"2020-02-12", "読めない日付"},
+	}
+	want := [][]string{
+		{jpx, "2019/12/31", "休業日", "1"},
+		{jpx, "2020/01/01", "元日", "1"},
+		{jpx, "2020/01/02", "", "1"},
+		{jpx, "2020/01/03", "休業日", "1"},
+		{jpx, "2020/01/13", "", "0"},
+		{jpx, "2020/02/11", "建国記念の日", "1"},
+	}
+	if got := holidayRecords(jpx, holidays, jpxHolidays); !reflect.DeepEqual(got, want) {
+		t.Errorf("holidayRecords() = %v, want %v", got, want)
+	}
+
+	// 規則にない臨時の休業日はそのまま書き込む
+	got := holidayRecords(nyse, []importedHoliday{{"2018/12/05", "National Day of Mourning"}}, nyseHolidays)
+	if want := [][]string{{nyse, "2018/12/05", "National Day of Mourning", "1"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("holidayRecords() = %v, want %v", got, want)
+	}
+
+	if got := holidayRecords(jpx, nil, jpxHolidays); len(got) != 0 {
+		t.Errorf("holidayRecords() with no holidays = %v, want none", got)
+	}
+}
+
+func TestReadHolidaySource(t *testing.T) {
+	body, err := readHolidaySource(nil, "testdata/nyse_holidays_test.ics", "")
+	if err != nil || !strings.HasPrefix(body, "BEGIN:VCALENDAR") {
+		t.Errorf("readHolidaySource(testdata/nyse_holidays_test.ics) = %.20q, %v", body, err)
+	}
+
+	tests := []struct {
+		file string
+		url  string
+	}{
+		{"main.go", ""},
+		{"testdata/../main.go", ""},
+		{"/etc/passwd", ""},
+		{"testdata/sub/nyse_holidays_test.ics", ""},
+		{"", "http://www.jpx.co.jp/corporate/about-jpx/calendar/index.html"},
+		{"", "https://example.com/calendar.html"},
+		{"", "https://jpx.co.jp.example.com/calendar.html"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if _, err := readHolidaySource(nil, tt.file, tt.url); err == nil {
+			t.Errorf("readHolidaySource(%q, %q): want error", tt.file, tt.url)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// 一目均衡表の計算と、雲や転換線・基準線によるシグナルの判定をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// 一目均衡表の期間
+const (
+	tenkanDays  = 9  // 転換線
+	kijunDays   = 26 // 基準線, 先行スパンと遅行スパンのずらす日数
+	senkouBDays = 52 // 先行スパンB
+)
+
+// 2: belowCloud : 終値が雲の下
+// 1: aboveCloud : 終値が雲の上
+// 0: inCloud : 終値が雲の中
+type cloudPosition int
+
+const (
+	inCloud cloudPosition = iota
+	aboveCloud
+	belowCloud
+)
+
+// constのString変換メソッド
+func (c cloudPosition) String() string {
+	return [3]string{"in", "above", "below"}[c]
+}
+
+// Stringの逆変換
+func parseCloudPosition(s string) (cloudPosition, error) {
+	for _, c := range []cloudPosition{inCloud, aboveCloud, belowCloud} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return inCloud, fmt.Errorf("unknown cloudPosition: '%s'", s)
+}
+
+// 一目均衡表の各線とシグナル
+// 先行スパンはその日付の位置に描かれる値(26日前に計算したもの)
+type ichimokuInfo struct {
+	Tenkan         float64       // 転換線
+	Kijun          float64       // 基準線
+	SenkouA        float64       // 先行スパンA
+	SenkouB        float64       // 先行スパンB
+	Chikou         float64       // 遅行スパン(その日の終値. 26日前の位置に描かれる)
+	Cloud          cloudPosition // 終値と雲の位置関係
+	TKCross        crossKind     // 転換線と基準線の直近のクロス
+	TKCrossDaysAgo int           // 何営業日前か(クロスがなければ-1)
+	ChikouAbove    bool          // 遅行スパンが26日前の終値より上か
+}
+
+// 古い順に並べた四本値の位置iまでのperiod日間の高値と安値の中値
+func highLowMid(bars []ohlc, i int, period int) float64 {
+	begin := i - period + 1
+	if begin < 0 {
+		begin = 0
+	}
+	high, low := bars[begin].High, bars[begin].Low
+	for j := begin + 1; j <= i; j++ {
+		if bars[j].High > high {
+			high = bars[j].High
+		}
+		if bars[j].Low < low {
+			low = bars[j].Low
+		}
+	}
+	return (high + low) / 2
+}
+
+// 古い順に並べた四本値からichimokuテーブルのレコードを作る
+// 先行スパンBを26日ずらすのに必要な78日目より前は保存しない
+func calcIchimokuRecords(code string, bars []ohlc) [][]string {
+	n := len(bars)
+	tenkan := make([]float64, n)
+	kijun := make([]float64, n)
+	spanB := make([]float64, n)
+	for i := range bars {
+		tenkan[i] = highLowMid(bars, i, tenkanDays)
+		kijun[i] = highLowMid(bars, i, kijunDays)
+		spanB[i] = highLowMid(bars, i, senkouBDays)
+	}
+
+	var records [][]string
+	for i := storeStart(n, senkouBDays+kijunDays); i < n; i++ {
+		// 先行スパンは26日前に計算した値
+		senkouA := (tenkan[i-kijunDays] + kijun[i-kijunDays]) / 2
+		senkouB := spanB[i-kijunDays]
+
+		cloud := inCloud
+		c := bars[i].Close
+		if c > senkouA && c > senkouB {
+			cloud = aboveCloud
+		} else if c < senkouA && c < senkouB {
+			cloud = belowCloud
+		}
+		tk, tkDays := lastCross(tenkan, kijun, i, kijunDays)
+		chikouAbove := "0"
+		if c > bars[i-kijunDays].Close {
+			chikouAbove = "1"
+		}
+
+		records = append(records, []string{code, bars[i].Date,
+			fmt.Sprintf("%f", tenkan[i]), fmt.Sprintf("%f", kijun[i]), fmt.Sprintf("%f", senkouA), fmt.Sprintf("%f", senkouB),
+			fmt.Sprintf("%f", c), cloud.String(), tk.String(), strconv.Itoa(tkDays), chikouAbove})
+	}
+	return records
+}
+
+// 銘柄コード、日付を渡すと該当のichimokuInfo structに対応する一目均衡表の値を返す
+func getIchimokuInfo(r *http.Request, db *sql.DB, code string, date string) (ichimokuInfo, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT tenkan, kijun, senkoua, senkoub, chikou, cloud, tkcross, tkcrossdays, chikouabove FROM ichimoku WHERE code = %s and date = '%s';",
+		code, date))
+	if err != nil {
+		return ichimokuInfo{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(ret) != 9 {
+		return ichimokuInfo{}, fmt.Errorf("no selected data")
+	}
+
+	var fs [5]float64
+	for i := 0; i < 5; i++ {
+		if fs[i], err = strconv.ParseFloat(ret[i], 64); err != nil {
+			return ichimokuInfo{}, fmt.Errorf("failed to ParseFloat %v", err)
+		}
+	}
+	cloud, err := parseCloudPosition(ret[5])
+	if err != nil {
+		return ichimokuInfo{}, err
+	}
+	tk, err := parseCrossKind(ret[6])
+	if err != nil {
+		return ichimokuInfo{}, err
+	}
+	tkDays, err := strconv.Atoi(ret[7])
+	if err != nil {
+		return ichimokuInfo{}, fmt.Errorf("failed to Atoi %v", err)
+	}
+	return ichimokuInfo{fs[0], fs[1], fs[2], fs[3], fs[4], cloud, tk, tkDays, ret[8] == "1"}, nil
+}
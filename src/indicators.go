@@ -0,0 +1,427 @@
+// 移動平均以外のテクニカル指標の計算をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// 指標の計算のためにDBから取得する日数
+// MACDやRSIの平滑化が十分効くように保存する日数より多めに取得する
+// 52週高値安値の250日分に保存する日数を足した分は必要
+const indicatorHistoryDays = 350
+
+// 指標をDBに保存する日数(movingavgと同じく直近100日分)
+const indicatorStoreDays = 100
+
+// 日付と四本値と売買高
+type ohlc struct {
+	Date     string
+	Open     float64
+	High     float64
+	Low      float64
+	Close    float64
+	Turnover float64
+}
+
+// 指標を保存するtableごとの定義
+// calcには古い順に並べた四本値を渡し、columnsの順に並べたレコードを返す
+type indicatorTable struct {
+	Name    string
+	Columns []string
+	Calc    func(code string, bars []ohlc) [][]string
+}
+
+// indicatorHandlerで計算して保存する指標のtable一覧
+var indicatorTables = []indicatorTable{
+	{
+		Name: "indicators",
+		Columns: []string{"code", "date", "rsi14", "macd", "macdsignal", "macdhistogram",
+			"bollingerupper", "bollingermiddle", "bollingerlower"},
+		Calc: calcIndicatorRecords,
+	},
+	{
+		Name:    "crosses",
+		Columns: []string{"code", "date", "cross5x25", "days5x25", "cross25x75", "days25x75"},
+		Calc:    calcCrossRecords,
+	},
+	{
+		Name: "ichimoku",
+		Columns: []string{"code", "date", "tenkan", "kijun", "senkoua", "senkoub", "chikou",
+			"cloud", "tkcross", "tkcrossdays", "chikouabove"},
+		Calc: calcIchimokuRecords,
+	},
+	{
+		Name:    "volatilities",
+		Columns: []string{"code", "date", "fastk", "fastd", "slowk", "slowd", "atr14", "atrpercent"},
+		Calc:    calcVolatilityRecords,
+	},
+	{
+		Name:    "highlows",
+		Columns: []string{"code", "date", "high52w", "low52w", "fromhigh", "fromlow", "newhigh", "newlow"},
+		Calc:    calcHighLowRecords,
+	},
+	{
+		Name:    "candles",
+		Columns: []string{"code", "date", "patterns"},
+		Calc:    calcCandleRecords,
+	},
+}
+
+// RSI, MACD, ボリンジャーバンドの値
+type indicatorInfo struct {
+	RSI14           float64 // 14日RSI
+	MACD            float64 // MACD(12, 26)
+	MACDSignal      float64 // MACDの9日シグナル
+	MACDHistogram   float64 // MACD - シグナル
+	BollingerUpper  float64 // 20日移動平均 + 2σ
+	BollingerMiddle float64 // 20日移動平均
+	BollingerLower  float64 // 20日移動平均 - 2σ
+}
+
+func indicatorHandler(w http.ResponseWriter, r *http.Request) {
+	processStartTime := time.Now().UTC()
+	// GAE log
+	ctx := appengine.NewContext(r)
+
+	// get environment var, sheet, db
+	sheet, db, err := initialize(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to initialize. err: %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to initialize. got environment var, sheet, db.")
+
+	// 休日データを取得
+	reg := getCalendarRegistry(r, sheet, db)
+	// 前の日がどの取引所でも休みの日だったら取得すべきデータがないので起動しない
+	if runEnv != "test" && !reg.PreviousDayOpen() {
+		log.Infof(ctx, "Previous day is not business day.")
+		return
+	}
+
+	// codesの指定がなければ最新の日付にある銘柄を取得
+	codes, err := getCodesParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(codes) == 0 {
+		codes, err = selectLatestCodes(r, db)
+		if err != nil {
+			log.Errorf(ctx, "failed to selectLatestCodes %v", err)
+			os.Exit(0)
+		}
+	}
+
+	targetRecordNum := 0
+	insertedRecordNum := 0
+	for _, code := range codes {
+		// test環境ではデータの存在する最新の日付に合わせる
+		previousBussinessDay := "2019/05/16"
+		// prod環境の場合は、銘柄の取引所の直近の取引日を取得する
+		if runEnv != "test" {
+			previousBussinessDay = reg.PreviousBussinessDay(code)
+		}
+		// 直近の四本値を取得して古い順に並べ替える
+		bars, err := getOrderedOHLCs(r, db, code, previousBussinessDay, indicatorHistoryDays)
+		if err != nil {
+			log.Errorf(ctx, "failed to getOrderedOHLCs. code: %s, err: %v", code, err)
+			continue
+		}
+		reverseOHLCs(bars)
+
+		for _, t := range indicatorTables {
+			records := t.Calc(code, bars)
+			if len(records) == 0 {
+				continue
+			}
+			targetRecordNum += len(records)
+			ins, err := insertDB(r, db, t.Name, t.Columns, records)
+			if err != nil {
+				log.Errorf(ctx, "failed to insertDB. table: %s, code: %s, err: %v", t.Name, code, err)
+				continue
+			}
+			insertedRecordNum += ins
+		}
+	}
+	if targetRecordNum != insertedRecordNum {
+		log.Errorf(ctx, "failed to write all records. target: %d, inserted: %d", targetRecordNum, insertedRecordNum)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to write all records. target: %d, inserted: %d", targetRecordNum, insertedRecordNum)
+	log.Infof(ctx, "done indicatorHandler. Elapsed time %v.", time.Since(processStartTime))
+}
+
+// 指標のtableとtimeframesテーブルから銘柄の全レコードを削除する
+// 株式分割で過去の修正後終値が変わり、保存済みの指標が使えなくなった場合に使う
+func deleteDerivedRecords(r *http.Request, db sqlRunner, code string) error {
+	tables := []string{"timeframes"}
+	for _, t := range indicatorTables {
+		tables = append(tables, t.Name)
+	}
+	for _, t := range tables {
+		if _, err := execDB(r, db, fmt.Sprintf("DELETE FROM %s WHERE code = %s;", t, code)); err != nil {
+			return fmt.Errorf("failed to delete %s. code: %s, err: %v", t, code, err)
+		}
+	}
+	return nil
+}
+
+// 銘柄の直近の指標と週足、月足をdailyから計算し直して上書きする
+// indicatorHandler, timeframeHandlerと同じく、指標は直近indicatorStoreDays日分、週足と月足は直近timeframeStoreBars本分を書き込む
+func recalcDerivedRecords(r *http.Request, db sqlRunner, code string) (int, error) {
+	bars, err := getOrderedOHLCs(r, db, code, "", timeframeHistoryDays)
+	if err != nil {
+		return 0, fmt.Errorf("failed to getOrderedOHLCs. code: %s, err: %v", code, err)
+	}
+	reverseOHLCs(bars)
+
+	replaced := 0
+	// 指標はindicatorHandlerと同じ日数だけ使う
+	recent := bars
+	if len(recent) > indicatorHistoryDays {
+		recent = recent[len(recent)-indicatorHistoryDays:]
+	}
+	for _, t := range indicatorTables {
+		records := t.Calc(code, recent)
+		if len(records) == 0 {
+			continue
+		}
+		n, err := replaceDB(r, db, t.Name, t.Columns, records)
+		if err != nil {
+			return replaced, fmt.Errorf("failed to replaceDB. table: %s, code: %s, err: %v", t.Name, code, err)
+		}
+		replaced += n
+	}
+	for _, tf := range timeframes {
+		records, err := calcTimeframeRecords(r, code, bars, tf)
+		if err != nil {
+			return replaced, fmt.Errorf("failed to calcTimeframeRecords. code: %s, timeframe: %s, err: %v", code, tf, err)
+		}
+		if len(records) == 0 {
+			continue
+		}
+		n, err := replaceDB(r, db, "timeframes", timeframeColumns, records)
+		if err != nil {
+			return replaced, fmt.Errorf("failed to replaceDB. table: timeframes, code: %s, err: %v", code, err)
+		}
+		replaced += n
+	}
+	return replaced, nil
+}
+
+// codeと取得する件数と検索する日付を与えると、
+// 日付と四本値、売買高の構造体を直近の日付順にして配列で返す関数
+// USE_MODIFIED_CLOSEが"true"の場合は始値、高値、安値も修正後終値と同じ比率で修正する
+func getOrderedOHLCs(r *http.Request, db sqlRunner, code string, latestDate string, limit int) ([]ohlc, error) {
+	limitStr := ""
+	if limit != 0 {
+		limitStr = fmt.Sprintf("LIMIT %d", limit)
+	}
+
+	latestDateStr := ""
+	if latestDate != "" {
+		latestDateStr = fmt.Sprintf("AND date <= '%s'", latestDate)
+	}
+
+	dbRet, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT date, open, high, low, close, turnover, modified FROM daily WHERE code = %s %s ORDER BY date DESC %s;",
+		code, latestDateStr, limitStr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(dbRet) == 0 {
+		return nil, fmt.Errorf("no selected data")
+	}
+
+	var bars []ohlc
+	// 日付, 始値, 高値, 安値, 終値, 売買高, 修正後終値の７つずつ取得
+	for i := 0; i+6 < len(dbRet); i += 7 {
+		var vs [6]float64
+		for j := 0; j < 6; j++ {
+			v, err := strconv.ParseFloat(dbRet[i+1+j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to ParseFloat. date: %s, %v", dbRet[i], err)
+			}
+			vs[j] = v
+		}
+		o := ohlc{Date: dbRet[i], Open: vs[0], High: vs[1], Low: vs[2], Close: vs[3], Turnover: vs[4]}
+		if useModifiedClose && o.Close != 0 {
+			adj := vs[5] / o.Close
+			o.Open, o.High, o.Low, o.Close = o.Open*adj, o.High*adj, o.Low*adj, vs[5]
+		}
+		bars = append(bars, o)
+	}
+	return bars, nil
+}
+
+// 四本値の並びをその場で逆順にする
+func reverseOHLCs(bars []ohlc) {
+	for i, j := 0, len(bars)-1; i < j; i, j = i+1, j-1 {
+		bars[i], bars[j] = bars[j], bars[i]
+	}
+}
+
+// 四本値から終値だけを取り出す
+func closesOf(bars []ohlc) []float64 {
+	cs := make([]float64, len(bars))
+	for i, o := range bars {
+		cs[i] = o.Close
+	}
+	return cs
+}
+
+// 古い順に並べた四本値からindicatorsテーブルのレコードを作る
+// MACDのシグナルが安定する35日目より前と、直近indicatorStoreDaysより古い日付は保存しない
+func calcIndicatorRecords(code string, bars []ohlc) [][]string {
+	closes := closesOf(bars)
+	rs := rsi(closes, 14)
+	m, sig, hist := macd(closes, 12, 26, 9)
+	upper, middle, lower := bollinger(closes, 20, 2)
+
+	var records [][]string
+	for i := storeStart(len(bars), 35); i < len(bars); i++ {
+		records = append(records, []string{code, bars[i].Date,
+			fmt.Sprintf("%f", rs[i]), fmt.Sprintf("%f", m[i]), fmt.Sprintf("%f", sig[i]), fmt.Sprintf("%f", hist[i]),
+			fmt.Sprintf("%f", upper[i]), fmt.Sprintf("%f", middle[i]), fmt.Sprintf("%f", lower[i])})
+	}
+	return records
+}
+
+// 保存を始める位置を返す
+// 計算に必要な日数warmupを満たし、かつ直近indicatorStoreDays分だけになるようにする
+func storeStart(length int, warmup int) int {
+	start := length - indicatorStoreDays
+	if start < warmup {
+		start = warmup
+	}
+	return start
+}
+
+// 古い順に並べた値のperiod日単純移動平均
+// 日数が足りない最初の方はそれまでの平均
+func sma(values []float64, period int) []float64 {
+	ret := make([]float64, len(values))
+	var sum float64
+	for i, v := range values {
+		sum += v
+		if i >= period {
+			sum -= values[i-period]
+		}
+		n := period
+		if i+1 < period {
+			n = i + 1
+		}
+		ret[i] = sum / float64(n)
+	}
+	return ret
+}
+
+// 古い順に並べた値のperiod日指数平滑移動平均
+// 最初の値を初期値にする
+func ema(values []float64, period int) []float64 {
+	ret := make([]float64, len(values))
+	if len(values) == 0 {
+		return ret
+	}
+	alpha := 2 / float64(period+1)
+	ret[0] = values[0]
+	for i := 1; i < len(values); i++ {
+		ret[i] = alpha*values[i] + (1-alpha)*ret[i-1]
+	}
+	return ret
+}
+
+// 古い順に並べた終値からWilderの平滑化によるperiod日RSIを計算する
+// 日数が足りない最初の方と、期間中に値動きがない場合は50(中立)
+func rsi(closes []float64, period int) []float64 {
+	ret := make([]float64, len(closes))
+	var avgGain, avgLoss float64
+	for i := range closes {
+		if i == 0 {
+			ret[i] = 50
+			continue
+		}
+		change := closes[i] - closes[i-1]
+		gain, loss := math.Max(change, 0), math.Max(-change, 0)
+		if i <= period {
+			// 最初のperiod日は単純平均
+			avgGain += gain / float64(period)
+			avgLoss += loss / float64(period)
+			if i < period {
+				ret[i] = 50
+				continue
+			}
+		} else {
+			avgGain = (avgGain*float64(period-1) + gain) / float64(period)
+			avgLoss = (avgLoss*float64(period-1) + loss) / float64(period)
+		}
+		// 値動きがなければ中立の50, 下落がなければ100
+		if avgLoss == 0 {
+			ret[i] = 100
+			if avgGain == 0 {
+				ret[i] = 50
+			}
+			continue
+		}
+		ret[i] = 100 - 100/(1+avgGain/avgLoss)
+	}
+	return ret
+}
+
+// 古い順に並べた終値からMACD, シグナル, ヒストグラムを計算する
+func macd(closes []float64, fast int, slow int, signal int) ([]float64, []float64, []float64) {
+	fastEMA := ema(closes, fast)
+	slowEMA := ema(closes, slow)
+	m := make([]float64, len(closes))
+	for i := range closes {
+		m[i] = fastEMA[i] - slowEMA[i]
+	}
+	sig := ema(m, signal)
+	hist := make([]float64, len(closes))
+	for i := range closes {
+		hist[i] = m[i] - sig[i]
+	}
+	return m, sig, hist
+}
+
+// 古い順に並べた終値からperiod日のボリンジャーバンド(±kσ)の上限、中心、下限を計算する
+func bollinger(closes []float64, period int, k float64) ([]float64, []float64, []float64) {
+	middle := sma(closes, period)
+	upper := make([]float64, len(closes))
+	lower := make([]float64, len(closes))
+	for i := range closes {
+		begin := i - period + 1
+		if begin < 0 {
+			begin = 0
+		}
+		var sq float64
+		for j := begin; j <= i; j++ {
+			d := closes[j] - middle[i]
+			sq += d * d
+		}
+		sd := math.Sqrt(sq / float64(i-begin+1))
+		upper[i] = middle[i] + k*sd
+		lower[i] = middle[i] - k*sd
+	}
+	return upper, middle, lower
+}
+
+// 銘柄コード、日付を渡すと該当のindicatorInfo structに対応する指標を返す
+func getIndicatorInfo(r *http.Request, db *sql.DB, code string, date string) (indicatorInfo, error) {
+	fs, err := getFloatColumns(r, db, "indicators", []string{"rsi14", "macd", "macdsignal", "macdhistogram",
+		"bollingerupper", "bollingermiddle", "bollingerlower"}, code, date)
+	if err != nil {
+		return indicatorInfo{}, err
+	}
+	return indicatorInfo{fs[0], fs[1], fs[2], fs[3], fs[4], fs[5], fs[6]}, nil
+}
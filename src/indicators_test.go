@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// 小数点以下の丸めを許して比較する
+func almostEqual(a, b, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestSMA(t *testing.T) {
+	tests := []struct {
+		values []float64
+		period int
+		want   []float64
+	}{
+		{[]float64{2, 4, 6, 8}, 2, []float64{2, 3, 5, 7}},
+		// 日数が足りない最初の方はそれまでの平均
+		{[]float64{1, 2, 3}, 5, []float64{1, 1.5, 2}},
+		{nil, 3, []float64{}},
+	}
+	for _, tt := range tests {
+		got := sma(tt.values, tt.period)
+		if len(got) != len(tt.want) {
+			t.Fatalf("sma(%v, %d) = %v, want %v", tt.values, tt.period, got, tt.want)
+		}
+		for i := range got {
+			if !almostEqual(got[i], tt.want[i], 1e-9) {
+				t.Errorf("sma(%v, %d)[%d] = %v, want %v", tt.values, tt.period, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestEMA(t *testing.T) {
+	// period 3 の平滑化係数は0.5
+	got := ema([]float64{1, 2, 3, 4}, 3)
+	want := []float64{1, 1.5, 2.25, 3.125}
+	for i := range want {
+		if !almostEqual(got[i], want[i], 1e-9) {
+			t.Errorf("ema[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if got := ema(nil, 3); len(got) != 0 {
+		t.Errorf("ema(nil) = %v, want empty", got)
+	}
+}
+
+func TestRSI(t *testing.T) {
+	// Wilderの例(StockChartsのRSIの解説にある値)
+	closes := []float64{44.3389, 44.0902, 44.1497, 43.6124, 44.3278, 44.8264, 45.0955, 45.4245, 45.8433, 46.0826,
+		45.8931, 46.0328, 45.6140, 46.2820, 46.2820, 46.0028, 46.0328, 46.4116, 46.2222, 45.6439}
+	want := map[int]float64{14: 70.53, 15: 66.32, 16: 66.55, 17: 69.41, 18: 66.36, 19: 57.97}
+	got := rsi(closes, 14)
+	for i := 0; i < 14; i++ {
+		if got[i] != 50 {
+			t.Errorf("rsi[%d] = %v, want 50 before the period", i, got[i])
+		}
+	}
+	for i, w := range want {
+		if !almostEqual(got[i], w, 0.01) {
+			t.Errorf("rsi[%d] = %.4f, want %.2f", i, got[i], w)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		closes []float64
+		want   float64
+	}{
+		{"only gains", []float64{1, 2, 3, 4, 5}, 100},
+		{"only losses", []float64{5, 4, 3, 2, 1}, 0},
+		{"no change", []float64{3, 3, 3, 3, 3}, 50},
+	}
+	for _, tt := range tests {
+		got := rsi(tt.closes, 3)
+		if last := got[len(got)-1]; !almostEqual(last, tt.want, 1e-9) {
+			t.Errorf("%s: rsi = %v, want %v", tt.name, last, tt.want)
+		}
+	}
+	if got := rsi(nil, 14); len(got) != 0 {
+		t.Errorf("rsi(nil) = %v, want empty", got)
+	}
+}
+
+func TestMACD(t *testing.T) {
+	// fast 1 はEMAが終値そのもの、slow 3 は平滑化係数0.5, signal 1 はMACDそのもの
+	m, sig, hist := macd([]float64{1, 2, 3, 4}, 1, 3, 1)
+	wantM := []float64{0, 0.5, 0.75, 0.875}
+	for i := range wantM {
+		if !almostEqual(m[i], wantM[i], 1e-9) || !almostEqual(sig[i], wantM[i], 1e-9) || !almostEqual(hist[i], 0, 1e-9) {
+			t.Errorf("macd[%d] = %v, %v, %v, want %v, %v, 0", i, m[i], sig[i], hist[i], wantM[i], wantM[i])
+		}
+	}
+
+	// 値が一定ならMACDは0
+	m, sig, hist = macd([]float64{10, 10, 10, 10, 10}, 12, 26, 9)
+	for i := range m {
+		if m[i] != 0 || sig[i] != 0 || hist[i] != 0 {
+			t.Errorf("macd of flat closes[%d] = %v, %v, %v, want 0", i, m[i], sig[i], hist[i])
+		}
+	}
+}
+
+func TestBollinger(t *testing.T) {
+	upper, middle, lower := bollinger([]float64{1, 2, 3, 4, 5}, 5, 2)
+	tests := []struct {
+		i                    int
+		upper, middle, lower float64
+	}{
+		// 一日目は標準偏差が0
+		{0, 1, 1, 1},
+		// 日数が足りない間はそれまでの値で計算する
+		{1, 2.5, 1.5, 0.5},
+		// 母標準偏差はsqrt(2)
+		{4, 3 + 2*math.Sqrt2, 3, 3 - 2*math.Sqrt2},
+	}
+	for _, tt := range tests {
+		if !almostEqual(upper[tt.i], tt.upper, 1e-9) || !almostEqual(middle[tt.i], tt.middle, 1e-9) || !almostEqual(lower[tt.i], tt.lower, 1e-9) {
+			t.Errorf("bollinger[%d] = %v, %v, %v, want %v, %v, %v",
+				tt.i, upper[tt.i], middle[tt.i], lower[tt.i], tt.upper, tt.middle, tt.lower)
+		}
+	}
+}
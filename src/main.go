@@ -5,6 +5,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
 	"reflect"
@@ -78,6 +79,10 @@ func toInterfaceSlice(v interface{}) []interface{} {
 	}
 	rt := rv.Type()
 	for i := 0; i < rt.NumField(); i++ {
+		// 小文字で始まるフィールドは出力しない
+		if rt.Field(i).PkgPath != "" {
+			continue
+		}
 		if rv.Field(i).Kind() == reflect.Struct {
 			// フィールドがstructの場合は再帰でinterfaceのSliceを取得して後ろにつなげる
 			sl := toInterfaceSlice(rv.Field(i).Interface()) // TODO: ここの引数がポインタじゃなくて値になってる。遅くならない？
@@ -110,6 +115,10 @@ func getColumnName(v interface{}) []interface{} {
 	}
 	rt := rv.Type()
 	for i := 0; i < rt.NumField(); i++ {
+		// 小文字で始まるフィールドは出力しない
+		if rt.Field(i).PkgPath != "" {
+			continue
+		}
 		if rv.Field(i).Kind() == reflect.Struct {
 			// フィールドがstructの場合は再帰でinterfaceのSliceを取得して後ろにつなげる
 			sl := getColumnName(rv.Field(i).Interface()) // TODO: ここの引数がポインタじゃなくて値になってる。遅くならない？
@@ -141,6 +150,43 @@ func (p pppKind) String() string {
 	return [5]string{"non", "oppositePPP", "oppositeSemiPPP", "semiPPP", "ppp"}[p]
 }
 
+// Stringの逆変換
+func parsePPPKind(s string) (pppKind, error) {
+	for _, p := range []pppKind{non, oppositePPP, oppositeSemiPPP, semiPPP, ppp} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return non, fmt.Errorf("unknown pppKind: '%s'", s)
+}
+
+// 2: bearishKahanshin : 逆下半身. 始値が移動平均より上で終値が移動平均より下
+// 1: bullishKahanshin : 下半身. 始値が移動平均より下で終値が移動平均より上
+// 0: noKahanshin : other
+type kahanshinKind int
+
+const (
+	noKahanshin kahanshinKind = iota
+	bullishKahanshin
+	bearishKahanshin
+)
+
+// constのString変換メソッド
+func (k kahanshinKind) String() string {
+	return [3]string{"none", "bullish", "bearish"}[k]
+}
+
+// ローソク足の実体が移動平均を横切るかどうかで下半身、逆下半身を判定する
+func checkKahanshinBody(open float64, close float64, moving float64) kahanshinKind {
+	if open < moving && moving < close {
+		return bullishKahanshin
+	}
+	if close < moving && moving < open {
+		return bearishKahanshin
+	}
+	return noKahanshin
+}
+
 type movings struct {
 	Moving5   float64 // ５日移動平均
 	Moving20  float64
@@ -187,12 +233,33 @@ func (i *increasingRateInfo) Interface() []interface{} {
 	return toInterfaceSlice(i)
 }
 
+// 売買高の移動平均と出来高倍率
+type volumeInfo struct {
+	Turnover5   float64 // 売買高の５日移動平均
+	Turnover25  float64 // 売買高の２５日移動平均
+	VolumeRatio float64 // 直近の売買高の２５日移動平均に対する比率
+}
+
 type marketInfo struct {
 	Code               string // 銘柄
 	Date               string // 直近の日付
 	PPPInfo            pppInfo
 	IncreasingRateInfo increasingRateInfo
-	KahanshinFlag      bool // 前日, 前々日の終値が５日移動平均を横切るか
+	KahanshinFlag      bool          `fact:"kahanshin"` // 前日, 前々日の終値が５日移動平均を横切るか
+	KahanshinKind      kahanshinKind // 直近の日のローソク足の実体がKAHANSHIN_MOVING_DAYS日移動平均を横切るか
+	PPPTransitionInfo  pppTransitionInfo
+	VolumeInfo         volumeInfo
+	IndicatorInfo      indicatorInfo
+	CrossInfo          crossInfo
+	IchimokuInfo       ichimokuInfo
+	VolatilityInfo     volatilityInfo
+	TimeframeInfo      timeframeInfo
+	HighLowInfo        highLowInfo
+	CandleInfo         candleInfo
+	RelativeInfo       relativeInfo
+	Sector             string // 東証33業種
+
+	missing map[string]bool // 取得できなかった項目名. 条件式では値がないものとして扱う
 }
 
 // 要素を全てinterfaceにしたスライスを返すメソッド
@@ -226,8 +293,16 @@ func main() {
 	http.HandleFunc("/_ah/start", start)
 	http.HandleFunc("/daily", dailyHandler)
 	http.HandleFunc("/movingavg", movingAvgHandler)
+	http.HandleFunc("/indicator", indicatorHandler)
+	http.HandleFunc("/timeframe", timeframeHandler)
+	http.HandleFunc("/relative", relativeHandler)
 	http.HandleFunc("/ensure_daily", ensureDailyDBHandler)
+	http.HandleFunc("/gaps", gapsHandler)
+	http.HandleFunc("/import_holidays", importHolidaysHandler)
 	http.HandleFunc("/calc", calcHandler)
+	http.HandleFunc("/breadth", breadthHandler)
+	http.HandleFunc("/signals", signalsHandler)
+	http.HandleFunc("/backtest", backtestHandler)
 	http.HandleFunc("/", indexHandler)
 	http.HandleFunc("/connect_db", connectDBHandler)
 	appengine.Main() // Starts the server to receive requests
@@ -278,6 +353,37 @@ func mustGetenv(r *http.Request, k string) string {
 	return v
 }
 
+// リクエストのパラメータから「2019/05/16」の形式の日付を取得する
+// 指定がない場合は空文字を返す
+func getDateParam(r *http.Request, key string) (string, error) {
+	v := r.FormValue(key)
+	if v == "" {
+		return "", nil
+	}
+	if _, err := time.Parse("2006/01/02", v); err != nil {
+		return "", fmt.Errorf("invalid %s: '%s'. format must be 2006/01/02", key, v)
+	}
+	return v, nil
+}
+
+// リクエストのパラメータcodes=1802,2587 から銘柄コードのスライスを取得する
+// 指定がない場合はnilを返す
+// SQLにそのまま埋め込むので数字だけの銘柄コードに限り、それ以外が含まれていればエラーを返す
+func getCodesParam(r *http.Request) ([]string, error) {
+	var codes []string
+	for _, c := range strings.Split(r.FormValue("codes"), ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(c); err != nil {
+			return nil, fmt.Errorf("invalid code: '%s'. codes must be numbers separated by commas", c)
+		}
+		codes = append(codes, c)
+	}
+	return codes, nil
+}
+
 // ブラウザでDBに接続できるか確認するためのHandler
 func connectDBHandler(w http.ResponseWriter, r *http.Request) {
 	// read environment values
@@ -324,15 +430,13 @@ func dailyHandler(w http.ResponseWriter, r *http.Request) {
 	log.Infof(ctx, "Succeeded to get sheet client")
 
 	/* // しょっちゅう動いていないことがあるので毎日動かしておく
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
 	// 以下はデバッグ用
 	//now := time.Date(2019, 5, 18, 10, 11, 12, 0, time.Local)
-	// 休日データを取得
-	holidayMap := getHolidaysFromSheet(r, sheetService)
+	// 休日データを取得. 戻す場合はdialSQLをこの前に移す
+	reg := getCalendarRegistry(r, sheetService, db)
 
-	// 前の日が休みの日だったら取得すべきデータがないので起動しない
-	if !isPreviousBussinessday(r, now, holidayMap) {
+	// 前の日がどの取引所でも休みの日だったら取得すべきデータがないので起動しない
+	if runEnv != "test" && !reg.PreviousDayOpen() {
 		log.Infof(ctx, "Previous day is not business day.")
 		return
 	}
@@ -358,6 +462,8 @@ func dailyHandler(w http.ResponseWriter, r *http.Request) {
 	target := 0
 	// 書き込めた件数
 	inserted := 0
+	// 検知した株式分割
+	var splits []split
 
 	// 書き込み対象のdaily の項目名
 	dailyColumns := []string{"code", "date", "open", "high", "low", "close", "turnover", "modified"}
@@ -379,6 +485,14 @@ func dailyHandler(w http.ResponseWriter, r *http.Request) {
 
 		target += len(prices)
 
+		// DBにある修正後終値と食い違っていたら株式分割があったとみなす
+		// 分割の検知に失敗しても日次の書き込みは続ける
+		ss, err := detectSplits(r, db, prices)
+		if err != nil {
+			log.Warningf(ctx, "failed to detectSplits. %v", err)
+		}
+		splits = append(splits, ss...)
+
 		// dailypriceをcloudsqlに挿入
 		ins, err := insertDB(r, db, "daily", dailyColumns, prices)
 		if err != nil {
@@ -389,6 +503,14 @@ func dailyHandler(w http.ResponseWriter, r *http.Request) {
 		inserted += ins
 	}
 
+	// 株式分割のあった銘柄の過去の修正後終値と移動平均を計算し直す
+	for _, sp := range splits {
+		log.Infof(ctx, "detected split. code: %s, date: %s, ratio: %f", sp.Code, sp.Date, sp.Ratio)
+		if err := applySplit(r, db, sp); err != nil {
+			log.Errorf(ctx, "failed to applySplit. %v", err)
+		}
+	}
+
 	if target != inserted {
 		log.Errorf(ctx, "failed to write all records. target: %d, inserted: %d", target, inserted)
 		os.Exit(0)
@@ -434,6 +556,291 @@ func getEachCodesPrices(r *http.Request, codes [][]interface{}) ([][]string, err
 	return codePrices, nil
 }
 
+// パラメータfrom, to, codesで指定された期間と銘柄の移動平均を計算し直してmovingavgを上書きする
+// fromかtoの片方しか指定がない場合はその一日だけを対象にする
+// codesの指定がない場合は最新の日付にある全銘柄が対象
+// 期間内の取引日は銘柄の取引所のカレンダーで求める
+func recalcMovingAvgRange(w http.ResponseWriter, r *http.Request, db *sql.DB, reg *calendarRegistry) {
+	ctx := appengine.NewContext(r)
+
+	from, err := getDateParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := getDateParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from == "" {
+		from = to
+	}
+	if to == "" {
+		to = from
+	}
+
+	codes, err := getCodesParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(codes) == 0 {
+		codes, err = selectLatestCodes(r, db)
+		if err != nil {
+			log.Errorf(ctx, "failed to selectLatestCodes %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// 取引所ごとに期間内の取引日を求めて計算し直す
+	// from, toはgetDateParamで形式を確認済み
+	f, _ := time.Parse("2006/01/02", from)
+	t, _ := time.Parse("2006/01/02", to)
+	calCodes := make(map[*tradingCalendar][]string)
+	for _, code := range codes {
+		cal := reg.ForCode(code)
+		calCodes[cal] = append(calCodes[cal], code)
+	}
+	replaced, opened := 0, 0
+	for cal, cs := range calCodes {
+		tradingDays := cal.Range(f, t)
+		if len(tradingDays) == 0 {
+			log.Infof(ctx, "no trading days between %s and %s. exchange: %s, codes: %d", from, to, cal.Name, len(cs))
+			continue
+		}
+		log.Infof(ctx, "recalculate moving average. exchange: %s, from: %s, to: %s, trading days: %d", cal.Name, from, to, len(tradingDays))
+		replaced += replaceMovingAvgs(r, db, cs, tradingDays)
+		opened++
+	}
+	if opened == 0 {
+		http.Error(w, fmt.Sprintf("no trading days between %s and %s", from, to), http.StatusBadRequest)
+		return
+	}
+	log.Infof(ctx, "done recalcMovingAvgRange. codes: %d, replaced: %d", len(codes), replaced)
+	fmt.Fprintf(w, "recalculated movingavg. from: %s, to: %s, codes: %d, records: %d\n", from, to, len(codes), replaced)
+}
+
+// 銘柄ごとに古い順に並べた取引日の移動平均を計算し直してmovingavgを上書きし、上書きした件数を返す
+func replaceMovingAvgs(r *http.Request, db *sql.DB, codes []string, tradingDays []time.Time) int {
+	ctx := appengine.NewContext(r)
+
+	if len(tradingDays) == 0 {
+		return 0
+	}
+	tradingDayMap := make(map[string]bool)
+	for _, d := range tradingDays {
+		tradingDayMap[d.Format("2006/01/02")] = true
+	}
+	to := tradingDays[len(tradingDays)-1].Format("2006/01/02")
+
+	replaced := 0
+	for _, code := range codes {
+		// 期間の最初の日でも100日移動平均が計算できるように100日分余分に取得する
+		records, err := calcMovingAvgRecords(r, db, code, to, len(tradingDays)+100)
+		if err != nil {
+			log.Errorf(ctx, "failed to calcMovingAvgRecords. code: %s, err: %v", code, err)
+			continue
+		}
+		var targets [][]string
+		for _, rec := range records {
+			// rec[1]は日付
+			if tradingDayMap[rec[1]] {
+				targets = append(targets, rec)
+			}
+		}
+		if len(targets) == 0 {
+			continue
+		}
+		n, err := replaceDB(r, db, "movingavg", movingavgColumns, targets)
+		if err != nil {
+			log.Errorf(ctx, "failed to replaceDB. code: %s, err: %v", code, err)
+			continue
+		}
+		replaced += n
+	}
+	return replaced
+}
+
+// 最新の日付にある銘柄を取得
+func selectLatestCodes(r *http.Request, db *sql.DB) ([]string, error) {
+	return selectTable(r, db,
+		"SELECT code FROM daily WHERE date = (SELECT date FROM daily ORDER BY date DESC LIMIT 1);")
+}
+
+// 株式分割の情報
+type split struct {
+	Code  string
+	Date  string  // 修正後終値が変わった最新の日付(分割の権利落ち日の前日)
+	Ratio float64 // 新しい修正後終値 / DBにある修正後終値
+}
+
+// 分割とみなすのに、同じ比率で修正後終値が変わっている必要がある連続した取引日数
+// 元データの一日だけの訂正で過去の修正後終値を全て書き換えないようにする
+const splitConfirmDays = 3
+
+// 株式分割(併合)の比率としてありうる値
+// 新しい修正後終値 / DBにある修正後終値はこの値かその逆数に近くなる
+var plausibleSplitRatios = []float64{1.1, 1.2, 1.25, 1.5, 2, 2.5, 3, 4, 5, 10}
+
+// 比率をありうる分割の比率に丸める. 1%以内に近いものがなければfalse
+func snapSplitRatio(ratio float64) (float64, bool) {
+	for _, p := range plausibleSplitRatios {
+		if math.Abs(ratio-p)/p < 0.01 {
+			return p, true
+		}
+		if math.Abs(ratio*p-1) < 0.01 {
+			return 1 / p, true
+		}
+	}
+	return 0, false
+}
+
+// スクレイピングした株価([code, date, open, high, low, close, turnover, modified])と
+// DBにある同じ日付の修正後終値を比較して、値が変わっている銘柄を株式分割として返す
+func detectSplits(r *http.Request, db *sql.DB, prices [][]string) ([]split, error) {
+	if len(prices) == 0 {
+		return nil, nil
+	}
+
+	// 検索対象の銘柄と最も古い日付
+	var codes []string
+	seen := make(map[string]bool)
+	oldest := prices[0][1]
+	for _, p := range prices {
+		if !seen[p[0]] {
+			seen[p[0]] = true
+			codes = append(codes, p[0])
+		}
+		if p[1] < oldest {
+			oldest = p[1]
+		}
+	}
+
+	dbRet, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT code, date, modified FROM daily WHERE code IN (%s) AND date >= '%s';", strings.Join(codes, ","), oldest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+	return findSplits(prices, dbRet), nil
+}
+
+// スクレイピングした株価と、DBの[code, date, modified, code, date, modified...]を比較して株式分割を返す
+// 修正後終値が食い違う最新の日付から古い方へsplitConfirmDays日続けて、同じありうる分割の比率で変わっている場合だけ分割とみなす
+func findSplits(prices [][]string, dbRet []string) []split {
+	// (code;(date;修正後終値))のMap
+	scraped := make(map[string]map[string]string)
+	var codes []string
+	for _, p := range prices {
+		code, date, modified := p[0], p[1], p[7]
+		if _, ok := scraped[code]; !ok {
+			scraped[code] = make(map[string]string)
+			codes = append(codes, code)
+		}
+		scraped[code][date] = modified
+	}
+
+	// 銘柄ごとの同じ日付の修正後終値の比率
+	type dateRatio struct {
+		Date  string
+		Ratio float64
+	}
+	ratios := make(map[string][]dateRatio)
+	for i := 0; i+2 < len(dbRet); i += 3 {
+		code, date := dbRet[i], dbRet[i+1]
+		newModified, ok := scraped[code][date]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(newModified, 64)
+		if err != nil {
+			continue
+		}
+		o, err := strconv.ParseFloat(dbRet[i+2], 64)
+		if err != nil || o == 0 {
+			continue
+		}
+		ratios[code] = append(ratios[code], dateRatio{date, n / o})
+	}
+
+	var splits []split
+	for _, code := range codes {
+		rs := ratios[code]
+		// 新しい順に並べて、修正後終値が食い違う最新の日付を探す
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Date > rs[j].Date })
+		k := 0
+		// 小数点の丸めによる誤差は分割とみなさない
+		for k < len(rs) && rs[k].Ratio > 0.999 && rs[k].Ratio < 1.001 {
+			k++
+		}
+		if k+splitConfirmDays > len(rs) {
+			continue
+		}
+		ratio, ok := snapSplitRatio(rs[k].Ratio)
+		for _, dr := range rs[k+1 : k+splitConfirmDays] {
+			if rr, rok := snapSplitRatio(dr.Ratio); !rok || rr != ratio {
+				ok = false
+			}
+		}
+		if ok {
+			splits = append(splits, split{Code: code, Date: rs[k].Date, Ratio: ratio})
+		}
+	}
+	return splits
+}
+
+// 株式分割の比率をDBの過去の修正後終値に反映する
+// 修正後終値で指標を計算している場合はその銘柄の移動平均を全期間、その他の指標と週足、月足を直近の分だけ計算し直す
+// 途中で失敗した場合に修正後終値と指標が食い違ったり移動平均が消えたりしないように、一つのトランザクションで行う
+func applySplit(r *http.Request, db *sql.DB, sp split) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction. code: %s, err: %v", sp.Code, err)
+	}
+	if err := applySplitTx(r, tx, sp); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("%v. and failed to rollback. %v", err, rerr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit. code: %s, err: %v", sp.Code, err)
+	}
+	return nil
+}
+
+func applySplitTx(r *http.Request, tx *sql.Tx, sp split) error {
+	if _, err := execDB(r, tx, fmt.Sprintf(
+		"UPDATE daily SET modified = modified * %f WHERE code = %s AND date <= '%s';", sp.Ratio, sp.Code, sp.Date)); err != nil {
+		return fmt.Errorf("failed to update modified. code: %s, err: %v", sp.Code, err)
+	}
+	if !useModifiedClose {
+		return nil
+	}
+
+	// 更新した修正後終値はトランザクションの中からしか見えないのでtxで読む
+	records, err := calcMovingAvgRecords(r, tx, sp.Code, "", 0)
+	if err != nil {
+		return fmt.Errorf("failed to calcMovingAvgRecords. code: %s, err: %v", sp.Code, err)
+	}
+	if _, err := execDB(r, tx, fmt.Sprintf("DELETE FROM movingavg WHERE code = %s;", sp.Code)); err != nil {
+		return fmt.Errorf("failed to delete movingavg. code: %s, err: %v", sp.Code, err)
+	}
+	if _, err := insertDB(r, tx, "movingavg", movingavgColumns, records); err != nil {
+		return fmt.Errorf("failed to insert movingavg. code: %s, err: %v", sp.Code, err)
+	}
+
+	// 分割前の値で計算した指標は古い日付の分も使えないので削除してから計算し直す
+	if err := deleteDerivedRecords(r, tx, sp.Code); err != nil {
+		return err
+	}
+	if _, err := recalcDerivedRecords(r, tx, sp.Code); err != nil {
+		return err
+	}
+	return nil
+}
+
 func movingAvgHandler(w http.ResponseWriter, r *http.Request) {
 	// GAE log
 	ctx := appengine.NewContext(r)
@@ -447,73 +854,45 @@ func movingAvgHandler(w http.ResponseWriter, r *http.Request) {
 	log.Infof(ctx, "succeeded to initialize. got environment var, sheet, db.")
 	//log.Infof(ctx, "%v %v", sheet, db)
 
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
 	// 休日データを取得
-	holidayMap := getHolidaysFromSheet(r, sheet)
-	// 前の日が休みの日だったら取得すべきデータがないので起動しない
-	if !isPreviousBussinessday(r, now, holidayMap) {
-		log.Infof(ctx, "Previous day is not business day.")
+	reg := getCalendarRegistry(r, sheet, db)
+
+	// /movingavg?from=2019/05/01&to=2019/05/16&codes=1802,2587 のように期間が指定された場合は
+	// その期間の取引日について移動平均を計算し直して上書きする
+	if r.FormValue("from") != "" || r.FormValue("to") != "" {
+		recalcMovingAvgRange(w, r, db, reg)
 		return
 	}
 
-	// test環境ではデータの存在する最新の日付に合わせる
-	previousBussinessDay := "2019/05/16"
-	// prod環境の場合は、直近の取引日を取得する
-	// 一日前から順番に見ていって、直近の休日ではない日を取引日として設定する
-	if runEnv != "test" {
-		// 直近の営業日を取得
-		previos, err := getPreviousBussinessDay(now, holidayMap)
-		if err != nil {
-			log.Errorf(ctx, "failed to getPreviousBussinessDay. %v", err)
-			os.Exit(0)
-		}
-		previousBussinessDay = previos
+	// 前の日がどの取引所でも休みの日だったら取得すべきデータがないので起動しない
+	if runEnv != "test" && !reg.PreviousDayOpen() {
+		log.Infof(ctx, "Previous day is not business day.")
+		return
 	}
-	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
 
 	// 最新の日付にある銘柄を取得
-	codes, err := selectTable(r, db,
-		"SELECT code FROM daily WHERE date = (SELECT date FROM daily ORDER BY date DESC LIMIT 1);")
+	codes, err := selectLatestCodes(r, db)
 	if err != nil {
-		log.Errorf(ctx, "failed to selectTable %v", err)
+		log.Errorf(ctx, "failed to selectLatestCodes %v", err)
 		os.Exit(0)
 	}
 	targetRecordNum := 0
 	insertedRecordNum := 0
 	for _, code := range codes {
-		// 直近 100日分最近から順にソートして取得
-		dcs, err := getOrderedDateCloses(r, db, code, previousBussinessDay, 100)
+		// test環境ではデータの存在する最新の日付に合わせる
+		previousBussinessDay := "2019/05/16"
+		// prod環境の場合は、銘柄の取引所の直近の取引日を取得する
+		if runEnv != "test" {
+			previousBussinessDay = reg.PreviousBussinessDay(code)
+		}
+		// 直近 100日分の移動平均を計算
+		codeDateMovings, err := calcMovingAvgRecords(r, db, code, previousBussinessDay, 100)
 		if err != nil {
-			log.Errorf(ctx, "failed to getOrderedDateCloses. code: %s, err: %v", code, err)
+			log.Errorf(ctx, "failed to calcMovingAvgRecords. code: %s, err: %v", code, err)
 			os.Exit(0)
 		}
-
-		// 取得対象の移動平均
-		movingDayList := []int{3, 5, 7, 10, 20, 60, 100}
-		// (日付;移動平均)のMapを3, 5, 7,...ごとに格納したMap
-		daysDateMovingMap := make(map[int]map[string]float64)
-		for _, d := range movingDayList {
-			daysDateMovingMap[d] = movingAverage(r, dcs, d)
-		}
-
-		// DBから取得できた日付はdcs[date].Dateで取れる
-		// code, date, moving3, moving5, moving7...のレコードを[][]stringの形にする
-		var codeDateMovings [][]string
-		for dateNum := 0; dateNum < len(dcs); dateNum++ {
-			date := dcs[dateNum].Date
-			var codeDateMoving []string
-			codeDateMoving = append(codeDateMoving, code)
-			codeDateMoving = append(codeDateMoving, date)
-			// movingDayList(3, 5, 7, 10, 20...)の順に対象の移動平均をスライスに詰める
-			for _, movingDay := range movingDayList {
-				codeDateMoving = append(codeDateMoving, fmt.Sprintf("%f", daysDateMovingMap[movingDay][date]))
-			}
-			codeDateMovings = append(codeDateMovings, codeDateMoving)
-		}
 		log.Infof(ctx, "moving average target code %s, dateSize: %d", code, len(codeDateMovings))
 		//log.Debugf(ctx, "codeDateMovings %v", codeDateMovings)
-		movingavgColumns := []string{"code", "date", "moving3", "moving5", "moving7", "moving10", "moving20", "moving60", "moving100"}
 
 		// 移動平均をDBに書き込み
 		// movingavgをcloudsqlに挿入
@@ -566,6 +945,71 @@ func movingAvgHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// 取得対象の移動平均
+var movingDayList = []int{3, 5, 7, 10, 20, 60, 100}
+
+// movingavgテーブルの項目名
+var movingavgColumns = []string{"code", "date", "moving3", "moving5", "moving7", "moving10", "moving20", "moving60", "moving100",
+	"turnover5", "turnover25", "volumeratio"}
+
+// 銘柄コード、最新の日付、取得件数を渡すと
+// movingavgColumnsの順に並べた移動平均のレコードを直近の日付順にして返す関数
+// 取得件数 limit: 指定しない場合は0(全件)
+// 検索する日付 latestDate: 指定しない場合は空(全件)
+func calcMovingAvgRecords(r *http.Request, db sqlRunner, code string, latestDate string, limit int) ([][]string, error) {
+	// 最近から順にソートして取得
+	dcs, err := getOrderedDateCloses(r, db, code, latestDate, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to getOrderedDateCloses. code: %s, err: %v", code, err)
+	}
+
+	// 同じ期間の売買高を取得
+	dts, err := getOrderedDateTurnovers(r, db, code, latestDate, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to getOrderedDateTurnovers. code: %s, err: %v", code, err)
+	}
+
+	// (日付;移動平均)のMapを3, 5, 7,...ごとに格納したMap
+	daysDateMovingMap := make(map[int]map[string]float64)
+	for _, d := range movingDayList {
+		daysDateMovingMap[d] = movingAverage(r, dcs, d)
+	}
+
+	// 取得対象の売買高の移動平均
+	turnoverDayList := []int{5, 25}
+	daysDateTurnoverMap := make(map[int]map[string]float64)
+	for _, d := range turnoverDayList {
+		daysDateTurnoverMap[d] = movingAverage(r, dts, d)
+	}
+	// (日付;売買高)のMap
+	dateTurnoverMap := make(map[string]float64)
+	for _, dt := range dts {
+		dateTurnoverMap[dt.Date] = dt.Close
+	}
+
+	// DBから取得できた日付はdcs[date].Dateで取れる
+	// code, date, moving3, moving5, moving7...のレコードを[][]stringの形にする
+	var codeDateMovings [][]string
+	for dateNum := 0; dateNum < len(dcs); dateNum++ {
+		date := dcs[dateNum].Date
+		var codeDateMoving []string
+		codeDateMoving = append(codeDateMoving, code)
+		codeDateMoving = append(codeDateMoving, date)
+		// movingDayList(3, 5, 7, 10, 20...)の順に対象の移動平均をスライスに詰める
+		for _, movingDay := range movingDayList {
+			codeDateMoving = append(codeDateMoving, fmt.Sprintf("%f", daysDateMovingMap[movingDay][date]))
+		}
+		// turnoverDayList(5, 25)の順に売買高の移動平均を詰める
+		for _, turnoverDay := range turnoverDayList {
+			codeDateMoving = append(codeDateMoving, fmt.Sprintf("%f", daysDateTurnoverMap[turnoverDay][date]))
+		}
+		// 出来高倍率: その日の売買高の25日平均に対する比率
+		codeDateMoving = append(codeDateMoving, fmt.Sprintf("%f", volumeRatio(dateTurnoverMap[date], daysDateTurnoverMap[25][date])))
+		codeDateMovings = append(codeDateMovings, codeDateMoving)
+	}
+	return codeDateMovings, nil
+}
+
 func movingAverage(r *http.Request, dcs []dateClose, avgDays int) map[string]float64 {
 	// GAE log
 	//ctx := appengine.NewContext(r)
@@ -595,6 +1039,22 @@ func movingAverage(r *http.Request, dcs []dateClose, avgDays int) map[string]flo
 	return dateMovingMap
 }
 
+// 売買高とその平均から出来高倍率を返す
+// 平均が0のとき(売買の無い銘柄など)は0を返す
+func volumeRatio(turnover float64, avg float64) float64 {
+	if avg == 0 {
+		return 0
+	}
+	return turnover / avg
+}
+
+// ５日移動平均を陽線または陰線で横切る場合はTrueを返す
+// 前日終値>５日移動平均>前々日終値 または 前々日終値>５日移動平均>前日終値
+func isKahanshin(inc increasingRateInfo, moving5 float64) bool {
+	return isAGreaterThanOrEqualToB(inc.PreviousClose, moving5, inc.BeforePreviousClose) ||
+		isAGreaterThanOrEqualToB(inc.BeforePreviousClose, moving5, inc.PreviousClose)
+}
+
 func calcHandler(w http.ResponseWriter, r *http.Request) {
 	processStartTime := time.Now().UTC()
 	// GAE log
@@ -608,39 +1068,54 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Infof(ctx, "succeeded to initialize. got environment var, sheet, db.")
 
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
 	// 休日データを取得
-	holidayMap := getHolidaysFromSheet(r, sheet)
+	reg := getCalendarRegistry(r, sheet, db)
 
 	// TODO: あとでコメント外すか考える
-	// // 前の日が休みの日だったら取得すべきデータがないので起動しない
-	// if !isPreviousBussinessday(r, now, holidayMap) {
+	// // 前の日がどの取引所でも休みの日だったら取得すべきデータがないので起動しない
+	// if runEnv != "test" && !reg.PreviousDayOpen() {
 	// 	log.Infof(ctx, "Previous day is not business day.")
 	// 	return
 	// }
 
 	// test環境ではデータの存在する最新の日付に合わせる
 	previousBussinessDay := "2019/05/16"
-	// prod環境の場合は、直近の取引日を取得する
-	// 一日前から順番に見ていって、直近の休日ではない日を取引日として設定する
-	if runEnv != "test" {
-		// 直近の営業日を取得
-		previos, err := getPreviousBussinessDay(now, holidayMap)
-		if err != nil {
-			log.Errorf(ctx, "failed to getPreviousBussinessDay. %v", err)
-			os.Exit(0)
+	// /calc?date=2019/05/16 のように日付が指定された場合はその日付で計算し直す
+	date, err := getDateParam(r, "date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if date != "" {
+		// 銘柄ごとの取引所の休みは銘柄ごとに除くので、どの取引所も休みの日だけを受け付けない
+		t, _ := time.Parse("2006/01/02", date)
+		if !reg.IsTradingDay(t) {
+			http.Error(w, fmt.Sprintf("%s is not business day on any exchange", date), http.StatusBadRequest)
+			return
 		}
-		previousBussinessDay = previos
+		previousBussinessDay = date
+	} else if runEnv != "test" {
+		// prod環境の場合は、直近の取引日を取得する
+		// 一日前から順番に見ていって、直近の休日ではない日を取引日として設定する
+		// 直近の営業日を取得
+		// JPX以外の銘柄は銘柄ごとに取引所の直近の取引日で計算する
+		previousBussinessDay = reg.Default.Prev(reg.Default.Now()).Format("2006/01/02")
 	}
 	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
 
-	// 最新の日付にある銘柄を取得
-	codes, err := selectTable(r, db,
-		"SELECT code FROM daily WHERE date = (SELECT date FROM daily ORDER BY date DESC LIMIT 1);")
+	// codesの指定がなければ最新の日付にある銘柄を取得
+	codes, err := getCodesParam(r)
 	if err != nil {
-		log.Errorf(ctx, "failed to selectTable %v", err)
-		os.Exit(0)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	allCodes := len(codes) == 0
+	if allCodes {
+		codes, err = selectLatestCodes(r, db)
+		if err != nil {
+			log.Errorf(ctx, "failed to selectLatestCodes %v", err)
+			os.Exit(0)
+		}
 	}
 	// debug用
 	// codes := []interface{}{}
@@ -650,16 +1125,36 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 	// }
 	log.Infof(ctx, "codes %v", codes)
 
+	// PPPの種類の変化を見るために前の取引日のsignalsを取得
+	// 取引所ごとに前の取引日が違うので日付ごとに一度だけ取得する
+	prevPPPsByDate := make(map[string]map[string]previousPPP)
+	getPrevPPPs := func(dayBefore string) (map[string]previousPPP, error) {
+		if prevs, ok := prevPPPsByDate[dayBefore]; ok {
+			return prevs, nil
+		}
+		prevs, err := getPreviousPPPs(r, db, dayBefore)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof(ctx, "fetched %d previous ppp. date: %s", len(prevs), dayBefore)
+		prevPPPsByDate[dayBefore] = prevs
+		return prevs, nil
+	}
+
+	// 銘柄ごとの東証33業種. sectorシートがなければ業種ごとの集計はしない
+	sectorMap := getSectorsFromSheet(r, sheet)
+	log.Infof(ctx, "fetched %d code sectors", len(sectorMap))
+
 	type pppResult struct {
 		Error   error
 		PPPInfo pppInfo
 	}
 	// 移動平均線の並びからPPPの種類を判定
-	calcPPP := func(done <-chan interface{}, code string) chan pppResult {
+	calcPPP := func(done <-chan interface{}, code string, date string) chan pppResult {
 		ch := make(chan pppResult)
 		go func() {
 			defer close(ch)
-			m, err := getMovings(r, db, code, previousBussinessDay)
+			m, err := getMovings(r, db, code, date)
 			if err != nil {
 				err = fmt.Errorf("failed to getMovings. %v", err)
 			}
@@ -677,12 +1172,12 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		IncreasingRateInfo increasingRateInfo
 	}
 	// 前日の終値の前々日の終値に対する増加率を返す
-	calcIncreasingRate := func(done <-chan interface{}, code string) chan increasingRateResult {
+	calcIncreasingRate := func(done <-chan interface{}, code string, date string) chan increasingRateResult {
 		ch := make(chan increasingRateResult)
 		go func() {
 			defer close(ch)
 			// 前日と前々日の終値を取得
-			closes, err := getOrderedDateCloses(r, db, code, previousBussinessDay, 2)
+			closes, err := getOrderedDateCloses(r, db, code, date, 2)
 			if err != nil {
 				err = fmt.Errorf("failed to getOrderedDateCloses. %v", err)
 			}
@@ -697,19 +1192,36 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		return ch
 	}
 
+	type volumeResult struct {
+		Error      error
+		VolumeInfo volumeInfo
+	}
+	// 売買高の移動平均と出来高倍率を取得
+	calcVolume := func(done <-chan interface{}, code string, date string) chan volumeResult {
+		ch := make(chan volumeResult)
+		go func() {
+			defer close(ch)
+			v, err := getVolumeInfo(r, db, code, date)
+			if err != nil {
+				err = fmt.Errorf("failed to getVolumeInfo. %v", err)
+			}
+			select {
+			case <-done:
+				return
+			case ch <- volumeResult{Error: err, VolumeInfo: v}:
+			}
+		}()
+		return ch
+	}
+
 	checkKahanshin := func(done chan interface{}, code string, inc *increasingRateInfo, m *float64) chan bool {
-		beforePreviousClose := inc.BeforePreviousClose
-		previousClose := inc.PreviousClose
-		moving5 := *m
 		ch := make(chan bool)
 		go func() {
 			defer close(ch)
 			select {
 			case <-done:
 				return
-			case ch <- isAGreaterThanOrEqualToB(previousClose, moving5, beforePreviousClose) || isAGreaterThanOrEqualToB(beforePreviousClose, moving5, previousClose):
-				// ５日移動平均を陽線または陰線で横切る場合はTrueを返す
-				// 前日終値>５日移動平均>前々日終値 または 前々日終値>５日移動平均>前日終値
+			case ch <- isKahanshin(*inc, *m):
 			}
 		}()
 		return ch
@@ -721,8 +1233,20 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		done := make(chan interface{})
 		defer close(done)
 
-		p := calcPPP(done, code)
-		incr := calcIncreasingRate(done, code)
+		// 日付の指定がなければ銘柄の取引所の直近の取引日で計算する
+		// 指定された日付が銘柄の取引所の休みの日ならその銘柄は計算しない
+		codeDate := previousBussinessDay
+		if date == "" && runEnv != "test" {
+			codeDate = reg.PreviousBussinessDay(code)
+		}
+		if t, _ := time.Parse("2006/01/02", codeDate); date != "" && !reg.ForCode(code).IsTradingDay(t) {
+			log.Infof(ctx, "skip code %s. %s is not business day on %s", code, date, reg.ForCode(code).Name)
+			continue
+		}
+
+		p := calcPPP(done, code, codeDate)
+		incr := calcIncreasingRate(done, code, codeDate)
+		vol := calcVolume(done, code, codeDate)
 
 		pppRes := <-p
 		if pppRes.Error != nil {
@@ -738,9 +1262,100 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		log.Infof(ctx, "succeeded to calcIncreasingRate. code: %s", code)
 
+		// 売買高は参考情報なので取得できなくても0のまま続ける
+		// 取得できなかった項目はスクリーニングの条件式で0として扱われないようにmissingに記録する
+		missing := make(map[string]bool)
+		volRes := <-vol
+		if volRes.Error != nil {
+			log.Warningf(ctx, "failed to calcVolume. code: %s, err: %v", code, volRes.Error)
+			addMissingFacts(missing, &volRes.VolumeInfo)
+		}
+
+		// RSIなどの指標も参考情報なので取得できなくても0のまま続ける
+		ind, err := getIndicatorInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getIndicatorInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &ind)
+		}
+
+		crs, err := getCrossInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getCrossInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &crs)
+		}
+
+		ich, err := getIchimokuInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getIchimokuInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &ich)
+		}
+
+		vola, err := getVolatilityInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getVolatilityInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &vola)
+		}
+
+		tfi, err := getTimeframeInfo(r, db, code, codeDate, pppRes.PPPInfo.PPP)
+		if err != nil {
+			log.Warningf(ctx, "failed to getTimeframeInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &tfi)
+		}
+
+		hl, err := getHighLowInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getHighLowInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &hl)
+		}
+
+		cdl, err := getCandleInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getCandleInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &cdl)
+		}
+
+		rel, err := getRelativeInfo(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getRelativeInfo. code: %s, err: %v", code, err)
+			addMissingFacts(missing, &rel)
+		}
+
+		// 前の取引日のsignalsがない場合は移動平均からPPPの種類を求める
+		// それ以前の履歴はわからないので連続日数は1日とする
+		t, _ := time.Parse("2006/01/02", codeDate)
+		dayBefore := reg.ForCode(code).Prev(t).Format("2006/01/02")
+		prevPPPs, err := getPrevPPPs(dayBefore)
+		if err != nil {
+			log.Errorf(ctx, "failed to getPreviousPPPs. date: %s, err: %v", dayBefore, err)
+			os.Exit(0)
+		}
+		prev, ok := prevPPPs[code]
+		if !ok {
+			m, err := getMovings(r, db, code, dayBefore)
+			if err != nil {
+				// 移動平均もなければ前の取引日のPPPの種類はわからない
+				log.Warningf(ctx, "failed to getMovings. code: %s, date: %s, err: %v", code, dayBefore, err)
+			}
+			prev = previousPPP{PPP: m.calcPPPKind(), Days: 1, Unknown: err != nil}
+		}
+		trans := calcPPPTransition(pppRes.PPPInfo.PPP, prev)
+		if prev.Unknown {
+			addMissingFacts(missing, &trans)
+		}
+
 		ka := checkKahanshin(done, code, &incrRes.IncreasingRateInfo, &pppRes.PPPInfo.Movings.Moving5)
 
-		mi := marketInfo{Code: code, Date: previousBussinessDay, PPPInfo: pppRes.PPPInfo, IncreasingRateInfo: incrRes.IncreasingRateInfo, KahanshinFlag: <-ka}
+		// ローソク足の実体による下半身の判定
+		kk, err := getKahanshinKind(r, db, code, codeDate)
+		if err != nil {
+			log.Warningf(ctx, "failed to getKahanshinKind. code: %s, err: %v", code, err)
+			missing["kahanshinKind"] = true
+		}
+
+		mi := marketInfo{Code: code, Date: codeDate, PPPInfo: pppRes.PPPInfo, IncreasingRateInfo: incrRes.IncreasingRateInfo, KahanshinFlag: <-ka,
+			KahanshinKind: kk, PPPTransitionInfo: trans, VolumeInfo: volRes.VolumeInfo, IndicatorInfo: ind, CrossInfo: crs,
+			IchimokuInfo: ich, VolatilityInfo: vola, TimeframeInfo: tfi,
+			HighLowInfo: hl, CandleInfo: cdl, RelativeInfo: rel, Sector: sectorMap[code], missing: missing}
 		mis = append(mis, mi)
 	}
 	log.Infof(ctx, "Elapsed time2  %v.", time.Since(processStartTime2))
@@ -753,14 +1368,36 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 		return mis[i].PPPInfo.PPP > mis[j].PPPInfo.PPP
 	})
 
-	// Sheetへ書き込みするために[][]interface{}型に直す
+	// 日ごとの結果が残るようにsignalsテーブルにも書き込む
+	if err := saveSignals(r, db, mis); err != nil {
+		log.Errorf(ctx, "failed to saveSignals. %v", err)
+	}
+
+	// 出力先へ書き込みするために[][]interface{}型に直す
 	misi := mis.Interface()
-	log.Infof(ctx, "trying to write sheet")
-	if err := clearAndWriteSheet(sheet, calcSheetID, "market", misi); err != nil {
-		log.Errorf(ctx, "failed to clearAndWriteSheet. %v", err)
+	// MARKET_SINKSで指定された出力先(指定がなければCALC_SHEETIDのmarketシート)に書き込む
+	sinks, err := getSinks(r, sheet, db, "market", calcSheetID)
+	if err != nil {
+		log.Errorf(ctx, "failed to getSinks. %v", err)
+		os.Exit(0)
+	}
+	defer closeSinks(sinks)
+	log.Infof(ctx, "trying to write market")
+	if err := writeSinks(sinks, "market", misi); err != nil {
+		log.Errorf(ctx, "failed to writeSinks. %v", err)
 		os.Exit(0)
 	}
-	log.Infof(ctx, "succeeded to write sheet")
+	log.Infof(ctx, "succeeded to write market")
+
+	// 設定ファイルのスクリーニング条件に合う銘柄をそれぞれの出力先に書き込む
+	runScreens(r, sheet, mis)
+
+	// 一部の銘柄だけを計算し直した場合は業種ごとの集計が偏るので書き込まない
+	if len(sectorMap) > 0 && allCodes {
+		if err := writeSectors(r, sheet, db, aggregateSectors(mis, previousBussinessDay)); err != nil {
+			log.Errorf(ctx, "failed to writeSectors. %v", err)
+		}
+	}
 
 	log.Infof(ctx, "done calcHandler. Elapsed time %v.", time.Since(processStartTime))
 }
@@ -769,7 +1406,28 @@ func calcHandler(w http.ResponseWriter, r *http.Request) {
 // 日付と終値の構造体を直近の日付順にして配列で返す関数
 // 取得する件数 limit: 指定しない場合は0
 // 検索する日付 latestDate: 指定しない場合は空. 指定した場合はその日付を最新のものとして検索
-func getOrderedDateCloses(r *http.Request, db *sql.DB, code string, latestDate string, limit int) ([]dateClose, error) {
+// USE_MODIFIED_CLOSEが"true"の場合は終値の代わりに修正後終値を返す
+func getOrderedDateCloses(r *http.Request, db sqlRunner, code string, latestDate string, limit int) ([]dateClose, error) {
+	return getOrderedDateValues(r, db, code, closeColumn(), latestDate, limit)
+}
+
+// 指標の計算に使う終値のdailyテーブルの項目名を返す
+// 株式分割で移動平均などが不連続にならないように修正後終値を使うこともできる
+func closeColumn() string {
+	if useModifiedClose {
+		return "modified"
+	}
+	return "close"
+}
+
+// getOrderedDateClosesの売買高版
+// movingAverageをそのまま使えるようにdateCloseのCloseに売買高を詰めて返す
+func getOrderedDateTurnovers(r *http.Request, db sqlRunner, code string, latestDate string, limit int) ([]dateClose, error) {
+	return getOrderedDateValues(r, db, code, "turnover", latestDate, limit)
+}
+
+// dailyテーブルの指定した項目(close, turnoverなど)を日付とともに直近の日付順にして配列で返す関数
+func getOrderedDateValues(r *http.Request, db sqlRunner, code string, column string, latestDate string, limit int) ([]dateClose, error) {
 	// TODO: ログ出さないならパラメータのrは不要
 	//ctx := appengine.NewContext(r)
 	limitStr := ""
@@ -783,7 +1441,7 @@ func getOrderedDateCloses(r *http.Request, db *sql.DB, code string, latestDate s
 	}
 
 	dbRet, err := selectTable(r, db, fmt.Sprintf(
-		"SELECT date, close FROM daily WHERE code = %s %s ORDER BY date DESC %s;", code, latestDateStr, limitStr))
+		"SELECT date, %s FROM daily WHERE code = %s %s ORDER BY date DESC %s;", column, code, latestDateStr, limitStr))
 	if err != nil {
 		return nil, fmt.Errorf("failed to selectTable %v", err)
 	}
@@ -830,28 +1488,64 @@ func getMoving(r *http.Request, db *sql.DB, code string, movingDay string, date
 // 銘柄コード、日付を渡すと該当のmovings structに対応するX日移動平均を返す
 // TODO：ベタ書きではなくreflectを使ってmovingsの項目が増えても対応できるようにしたい
 func getMovings(r *http.Request, db *sql.DB, code string, date string) (movings, error) {
-	//ctx := appengine.NewContext(r)
-
 	movingDays := []string{"moving5", "moving20", "moving60", "moving100"}
-	ms, err := selectTable(r, db, fmt.Sprintf(
-		"SELECT %s FROM movingavg WHERE code = %s and date = '%s';", strings.Join(movingDays, ","), code, date))
+	mf, err := getFloatColumns(r, db, "movingavg", movingDays, code, date)
 	if err != nil {
-		return movings{}, fmt.Errorf("failed to selectTable %v", err)
+		return movings{}, err
+	}
+	return movings{mf[0], mf[1], mf[2], mf[3]}, nil
+}
+
+// 銘柄コード、日付を渡すとその日の始値と終値、KAHANSHIN_MOVING_DAYS日移動平均から下半身を判定して返す
+func getKahanshinKind(r *http.Request, db *sql.DB, code string, date string) (kahanshinKind, error) {
+	bars, err := getOrderedOHLCs(r, db, code, date, 1)
+	if err != nil {
+		return noKahanshin, fmt.Errorf("failed to getOrderedOHLCs. %v", err)
+	}
+	if bars[0].Date != date {
+		return noKahanshin, fmt.Errorf("no daily data. date: %s", date)
+	}
+	m, err := getFloatColumns(r, db, "movingavg", []string{fmt.Sprintf("moving%d", kahanshinMovingDays)}, code, date)
+	if err != nil {
+		return noKahanshin, err
+	}
+	return checkKahanshinBody(bars[0].Open, bars[0].Close, m[0]), nil
+}
+
+// 銘柄コード、日付を渡すと該当のvolumeInfo structに対応する売買高の移動平均と出来高倍率を返す
+func getVolumeInfo(r *http.Request, db *sql.DB, code string, date string) (volumeInfo, error) {
+	vf, err := getFloatColumns(r, db, "movingavg", []string{"turnover5", "turnover25", "volumeratio"}, code, date)
+	if err != nil {
+		return volumeInfo{}, err
+	}
+	return volumeInfo{vf[0], vf[1], vf[2]}, nil
+}
+
+// table名、項目名、銘柄コード、日付を渡すと該当の項目をfloat64に変換して項目の順に返す
+func getFloatColumns(r *http.Request, db *sql.DB, table string, columns []string, code string, date string) ([]float64, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE code = %s and date = '%s';", strings.Join(columns, ","), table, code, date))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
 	}
-	if len(ms) == 0 {
-		return movings{}, fmt.Errorf("no selected data")
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no selected data")
 	}
 
-	var mf []float64
-	for _, m := range ms {
-		// []interface型のmsをfloat64に変換
-		f, err := strconv.ParseFloat(m, 64)
+	var fs []float64
+	for i, v := range ret {
+		// 項目を追加する前のレコードはNULLで、selectTableでは空文字になるので値がないものとして扱う
+		if v == "" {
+			return nil, fmt.Errorf("%s is NULL. code: %s, date: %s", columns[i%len(columns)], code, date)
+		}
+		// string型の値をfloat64に変換
+		f, err := strconv.ParseFloat(v, 64)
 		if err != nil {
-			return movings{}, fmt.Errorf("failed to ParseFloat %v", err)
+			return nil, fmt.Errorf("failed to ParseFloat %v", err)
 		}
-		mf = append(mf, f)
+		fs = append(fs, f)
 	}
-	return movings{mf[0], mf[1], mf[2], mf[3]}, nil
+	return fs, nil
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -871,12 +1565,11 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		log.Errorf(ctx, "err: %v", err)
 		os.Exit(0)
 	}
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
 	// 休日データを取得
-	holidayMap := getHolidaysFromSheet(r, sheetService)
+	// このHandlerはDBと接続しないので、休業日の上書きはholidayシートから読み取る
+	cal := getTradingCalendar(r, sheetService, nil)
 	// 前の日が休みの日だったら取得すべきデータがないので起動しない
-	if !isPreviousBussinessday(r, now, holidayMap) {
+	if runEnv != "test" && !cal.PreviousDayOpen() {
 		log.Infof(ctx, "Previous day is not business day.")
 		return
 	}
@@ -930,15 +1623,18 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	sort.SliceStable(wholeCodeRate, func(i, j int) bool { return wholeCodeRate[i].Rate[0] > wholeCodeRate[j].Rate[0] })
 	fmt.Fprintln(w, wholeCodeRate)
 
-	// 事前にrateのシートをclear
-	sheetName := "rate"
-	if err := clearSheet(sheetService, rateSheetID, sheetName); err != nil {
-		log.Errorf(ctx, "failed to clearSheet. sheetID: %s, sheetName: %s", rateSheetID, sheetName)
+	// RATE_SINKSで指定された出力先(指定がなければRATE_SHEETIDのrateシート)に
+	// 株価の比率順にソートしたものを書き込み
+	sinks, err := getSinks(r, sheetService, nil, "rate", rateSheetID)
+	if err != nil {
+		log.Errorf(ctx, "failed to getSinks. %v", err)
+		os.Exit(0)
+	}
+	defer closeSinks(sinks)
+	if err := writeSinks(sinks, "rate", rateTable(wholeCodeRate)); err != nil {
+		log.Errorf(ctx, "failed to writeSinks. %v", err)
 		os.Exit(0)
 	}
-
-	// 株価の比率順にソートしたものを書き込み
-	writeRate(sheetService, r, wholeCodeRate, rateSheetID, "rate")
 }
 
 var (
@@ -949,6 +1645,9 @@ var (
 	dailyRateSheetID  string
 	rateSheetID       string
 	calcSheetID       string
+	useModifiedClose  bool
+	// 下半身の判定に使う移動平均の日数
+	kahanshinMovingDays int
 )
 
 func getEnv(r *http.Request) {
@@ -962,29 +1661,74 @@ func getEnv(r *http.Request) {
 		log.Errorf(ctx, "ENV must be 'test' or 'prod': %v", runEnv)
 		os.Exit(0)
 	}
-	holidaySheetID = mustGetenv(r, "HOLIDAY_SHEETID")
+	// 休業日は規則から求めるので、上書き用のholidayシートは指定しなくてもよい
+	holidaySheetID = os.Getenv("HOLIDAY_SHEETID")
 	stockPriceSheetID = mustGetenv(r, "STOCKPRICE_SHEETID")
 	dailyRateSheetID = mustGetenv(r, "DAILYRATE_SHEETID")
 	rateSheetID = mustGetenv(r, "RATE_SHEETID")
 	calcSheetID = mustGetenv(r, "CALC_SHEETID")
+	// 指定がなければ終値(close)を使う
+	useModifiedClose = os.Getenv("USE_MODIFIED_CLOSE") == "true"
+	log.Infof(ctx, "USE_MODIFIED_CLOSE: %v", useModifiedClose)
+
+	// 指定がなければ５日移動平均を使う
+	kahanshinMovingDays = 5
+	if v := os.Getenv("KAHANSHIN_MOVING_DAYS"); v != "" {
+		d, err := strconv.Atoi(v)
+		if err != nil || !isMovingavgDays(d) {
+			// movingavgテーブルにない日数の場合は異常終了
+			log.Errorf(ctx, "KAHANSHIN_MOVING_DAYS must be one of %v: %v", movingDayList, v)
+			os.Exit(0)
+		}
+		kahanshinMovingDays = d
+	}
 }
 
-// spreadsheetの'holiday' sheetを読み取って、{"2019/01/01", true}のような祝日のMapを作成して返す
-func getHolidaysFromSheet(r *http.Request, srv *sheets.Service) map[string]bool {
+// movingavgテーブルに保存している移動平均の日数かどうか
+func isMovingavgDays(days int) bool {
+	for _, d := range movingDayList {
+		if d == days {
+			return true
+		}
+	}
+	return false
+}
+
+// spreadsheetの'holiday'などのsheetを読み取って、{"2019/01/01", true}のような休業日の上書きのMapを作成して返す
+// 休業日はgetHolidaysで規則から求めるので、シートには規則で求められない日付だけを書いておけばよい
+// optionalがtrueの場合はsheetがなくてもよいので再試行しない
+func getHolidaysFromSheet(r *http.Request, srv *sheets.Service, sheetName string, optional bool) map[string]bool {
 	ctx := appengine.NewContext(r)
-	// 'holiday' sheet を読み取り
+	holidayMap := map[string]bool{}
+	// HOLIDAY_SHEETIDの指定がなければ上書きはなし
+	if holidaySheetID == "" {
+		return holidayMap
+	}
+	// JPXは'holiday', NYSEは'holiday_nyse' sheet を読み取り
 	// sheetには「2019/01/01」の形式の休日が縦一列になっていることを想定している
+	// 二列目に「open」と書いた日付は規則では休業日でも取引日として扱う
 	// 東京証券取引所の休日: https://www.jpx.co.jp/corporate/calendar/index.html
-	holidays := getSheetData(r, srv, holidaySheetID, "holiday")
-	if holidays == nil || len(holidays) == 0 {
-		log.Infof(ctx, "Failed to get holidays.")
-		os.Exit(0)
+	var holidays [][]interface{}
+	if optional {
+		holidays = getOptionalSheetData(r, srv, holidaySheetID, sheetName)
+	} else {
+		holidays = getSheetData(r, srv, holidaySheetID, sheetName)
 	}
-	holidayMap := map[string]bool{}
-	// [][]interface{}型のholidaysを読み取り、holidayはtrueとなるMapを作成
+	if len(holidays) == 0 {
+		log.Infof(ctx, "no holidays in sheet.")
+		return holidayMap
+	}
+	// [][]interface{}型のholidaysを読み取り、holidayはtrue、取引日はfalseとなるMapを作成
 	for _, row := range holidays {
-		holiday := row[0].(string)
-		holidayMap[holiday] = true
+		if len(row) == 0 {
+			continue
+		}
+		holiday, ok := row[0].(string)
+		if !ok || holiday == "" {
+			continue
+		}
+		open := len(row) >= 2 && row[1] == "open"
+		holidayMap[holiday] = !open
 	}
 	return holidayMap
 }
@@ -1297,43 +2041,27 @@ func ensureDailyDBHandler(w http.ResponseWriter, r *http.Request) {
 		os.Exit(0)
 	}
 
-	jst, _ := time.LoadLocation("Asia/Tokyo")
-	now := time.Now().In(jst)
+	// cloud sql(ローカルの場合はmysql)と接続
+	// 休業日の上書きもこのDBのholidaysテーブルから読み取る
+	db, err := dialSQL(r)
+	if err != nil {
+		log.Errorf(ctx, "Could not open db: %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "Succeded to open db")
+
 	// 以下はデバッグ用
 	//now := time.Date(2019, 5, 18, 10, 11, 12, 0, time.Local)
 	// 休日データを取得
-	holidayMap := getHolidaysFromSheet(r, sheetService)
-	// 前の日が休みの日だったら取得すべきデータがないので起動しない
-	if !isPreviousBussinessday(r, now, holidayMap) {
+	reg := getCalendarRegistry(r, sheetService, db)
+	// 前の日がどの取引所でも休みの日だったら取得すべきデータがないので起動しない
+	if runEnv != "test" && !reg.PreviousDayOpen() {
 		log.Infof(ctx, "Previous day is not business day.")
 		return
 	}
 
-	// test環境ではデータの存在する最新の日付に合わせる
-	previousBussinessDay := "2019/05/16"
-	// prod環境の場合は、直近の取引日を取得する
-	// 一日前から順番に見ていって、直近の休日ではない日を取引日として設定する
-	if runEnv != "test" {
-		// 直近の営業日を取得
-		previos, err := getPreviousBussinessDay(now, holidayMap)
-		if err != nil {
-			log.Errorf(ctx, "failed to getPreviousBussinessDay. %v", err)
-			os.Exit(0)
-		}
-		previousBussinessDay = previos
-	}
-	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
-
 	// あとで全銘柄と比較するためにDBの直近の取引日のデータに含まれる銘柄を取得してmapに格納
-	codesInDb := func() map[int]bool {
-		// cloud sql(ローカルの場合はmysql)と接続
-		db, err := dialSQL(r)
-		if err != nil {
-			log.Errorf(ctx, "Could not open db: %v", err)
-			os.Exit(0)
-		}
-		log.Infof(ctx, "Succeded to open db")
-
+	codesInDb := func(previousBussinessDay string) map[int]bool {
 		query := fmt.Sprintf("SELECT code FROM daily WHERE date = '%s'", previousBussinessDay)
 		dbRet, err := selectTable(r, db, query)
 		if err != nil {
@@ -1351,7 +2079,8 @@ func ensureDailyDBHandler(w http.ResponseWriter, r *http.Request) {
 		//log.Infof(ctx, "dbcodes %v", dbCodesMap)
 		return dbCodesMap
 	}
-	dbCodesMap := codesInDb()
+	// 直近の取引日は銘柄の取引所ごとに違うので、取引日ごとにDBの銘柄を取得する
+	dbCodesMaps := make(map[string]map[int]bool)
 
 	// spreadsheetから銘柄コードを取得
 	codes := getSheetData(r, sheetService, codeSheetID, "ichibu")
@@ -1365,6 +2094,17 @@ func ensureDailyDBHandler(w http.ResponseWriter, r *http.Request) {
 	//	全銘柄分がdbにあるか確認する
 	var notExistInDb []int
 	for _, v := range codes {
+		// test環境ではデータの存在する最新の日付に合わせる
+		// prod環境の場合は、銘柄の取引所の直近の取引日を取得する
+		previousBussinessDay := "2019/05/16"
+		if runEnv != "test" {
+			previousBussinessDay = reg.PreviousBussinessDay(v[0].(string))
+		}
+		dbCodesMap, ok := dbCodesMaps[previousBussinessDay]
+		if !ok {
+			dbCodesMap = codesInDb(previousBussinessDay)
+			dbCodesMaps[previousBussinessDay] = dbCodesMap
+		}
 		code, _ := strconv.Atoi(v[0].(string))
 		if !dbCodesMap[code] {
 			// dbになければnotExistInDbにその銘柄を追加
@@ -1376,38 +2116,6 @@ func ensureDailyDBHandler(w http.ResponseWriter, r *http.Request) {
 		log.Errorf(ctx, "failed to write all codes data to db. unmatched!! not exist in db: %v", notExistInDb)
 		os.Exit(0)
 	}
-	log.Infof(ctx, "succeeded to write all %d codes data to db.", len(dbCodesMap))
+	log.Infof(ctx, "succeeded to write all %d codes data to db.", len(codes))
 	log.Infof(ctx, "done ensureDailyDBHandler.")
 }
-
-// 与えられた日付の前日が取引日かどうかを判定する関数
-// 実行時の日付time.Now().In(jst)と休日のMapを渡す
-func isPreviousBussinessday(r *http.Request, t time.Time, holidayMap map[string]bool) bool {
-	ctx := appengine.NewContext(r)
-
-	log.Infof(ctx, "Is previous day Bussinessday? Received date: %v", t)
-	if runEnv == "test" {
-		// test環境は常にtrue
-		log.Infof(ctx, "This is test env. no need to check.")
-		return true
-	}
-
-	// 以下はprodの場合
-
-	// 直近の営業日を取得
-	previousBussinessDay, err := getPreviousBussinessDay(t, holidayMap)
-	if err != nil {
-		log.Errorf(ctx, "failed to getPreviousBussinessDay. %v", err)
-		os.Exit(0)
-	}
-	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
-
-	// 日付を１日ずらすためにtime.Time型に修正してから計算
-	previousTime, _ := time.Parse("2006/01/02", previousBussinessDay)
-	previousTimeNextDay := previousTime.AddDate(0, 0, 1)
-	if t.Format("2006/01/02") == previousTimeNextDay.Format("2006/01/02") {
-		log.Infof(ctx, "previous day is BussinessDay.")
-		return true
-	}
-	return false
-}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSnapSplitRatio(t *testing.T) {
+	tests := []struct {
+		ratio float64
+		want  float64
+		ok    bool
+	}{
+		{0.5, 0.5, true},
+		{0.5004, 0.5, true},
+		{2.01, 2, true},
+		{0.3333, 1.0 / 3, true},
+		{0.1, 0.1, true},
+		{0.8, 0.8, true},
+		{0.97, 0, false},
+		{1.7, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := snapSplitRatio(tt.ratio)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("snapSplitRatio(%v) = %v, %v, want %v, %v", tt.ratio, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// [code, date, open, high, low, close, turnover, modified]の形の株価
+func price(code string, date string, modified string) []string {
+	return []string{code, date, "0", "0", "0", "0", "0", modified}
+}
+
+func TestFindSplits(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices [][]string
+		dbRet  []string
+		want   []split
+	}{
+		{
+			name: "1:2 split",
+			prices: [][]string{
+				price("1802", "2019/05/16", "500"), price("1802", "2019/05/15", "495"),
+				price("1802", "2019/05/14", "490"), price("1802", "2019/05/13", "505"),
+			},
+			dbRet: []string{
+				"1802", "2019/05/16", "500",
+				"1802", "2019/05/15", "990",
+				"1802", "2019/05/14", "980",
+				"1802", "2019/05/13", "1010",
+			},
+			want: []split{{Code: "1802", Date: "2019/05/15", Ratio: 0.5}},
+		},
+		{
+			name: "rounding is not a split",
+			prices: [][]string{
+				price("1802", "2019/05/16", "500.1"), price("1802", "2019/05/15", "495"),
+				price("1802", "2019/05/14", "490"), price("1802", "2019/05/13", "505"),
+			},
+			dbRet: []string{
+				"1802", "2019/05/16", "500",
+				"1802", "2019/05/15", "495",
+				"1802", "2019/05/14", "490",
+				"1802", "2019/05/13", "505",
+			},
+			want: nil,
+		},
+		{
+			name: "one day data correction",
+			prices: [][]string{
+				price("1802", "2019/05/16", "500"), price("1802", "2019/05/15", "450"),
+				price("1802", "2019/05/14", "490"), price("1802", "2019/05/13", "505"),
+			},
+			dbRet: []string{
+				"1802", "2019/05/16", "500",
+				"1802", "2019/05/15", "900",
+				"1802", "2019/05/14", "490",
+				"1802", "2019/05/13", "505",
+			},
+			want: nil,
+		},
+		{
+			name: "not a plausible split ratio",
+			prices: [][]string{
+				price("1802", "2019/05/16", "500"), price("1802", "2019/05/15", "582"),
+				price("1802", "2019/05/14", "576"), price("1802", "2019/05/13", "594"),
+			},
+			dbRet: []string{
+				"1802", "2019/05/16", "500",
+				"1802", "2019/05/15", "990",
+				"1802", "2019/05/14", "980",
+				"1802", "2019/05/13", "1010",
+			},
+			want: nil,
+		},
+		{
+			name: "not enough days to confirm",
+			prices: [][]string{
+				price("1802", "2019/05/16", "500"), price("1802", "2019/05/15", "495"),
+				price("1802", "2019/05/14", "490"),
+			},
+			dbRet: []string{
+				"1802", "2019/05/16", "500",
+				"1802", "2019/05/15", "990",
+				"1802", "2019/05/14", "980",
+			},
+			want: nil,
+		},
+		{
+			name: "reverse split and unchanged code",
+			prices: [][]string{
+				price("2587", "2019/05/16", "3000"), price("2587", "2019/05/15", "3000"),
+				price("2587", "2019/05/14", "3100"), price("2587", "2019/05/13", "2950"),
+				price("1802", "2019/05/16", "500"), price("1802", "2019/05/15", "495"),
+				price("1802", "2019/05/14", "490"), price("1802", "2019/05/13", "505"),
+			},
+			dbRet: []string{
+				"1802", "2019/05/16", "500",
+				"1802", "2019/05/15", "495",
+				"1802", "2019/05/14", "490",
+				"1802", "2019/05/13", "505",
+				"2587", "2019/05/16", "300",
+				"2587", "2019/05/15", "300",
+				"2587", "2019/05/14", "310",
+				"2587", "2019/05/13", "295",
+			},
+			want: []split{{Code: "2587", Date: "2019/05/16", Ratio: 10}},
+		},
+	}
+	for _, tt := range tests {
+		got := findSplits(tt.prices, tt.dbRet)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: findSplits() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// 取引所ごとのカレンダーと、銘柄ごとの上場している取引所の対応
+// 東証の銘柄に加えて米国のADRやETFも扱えるように、銘柄ごとに取引所のカレンダーとタイムゾーンで取引日を求める
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// 取引所の名前
+const (
+	jpx  = "JPX"  // 日本取引所グループ(東京証券取引所)
+	nyse = "NYSE" // ニューヨーク証券取引所
+)
+
+// 規則で求められないNYSEの臨時の休業日(同時多発テロ、ハリケーン、元大統領の国葬など)
+var nyseSpecialClosures = []string{
+	"2001/09/11", "2001/09/12", "2001/09/13", "2001/09/14",
+	"2004/06/11", "2007/01/02", "2012/10/29", "2012/10/30",
+	"2018/12/05", "2025/01/09",
+}
+
+// 月のn番目のweekday. nが負の場合は月の最後から数える
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) time.Time {
+	if n < 0 {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		offset := (int(last.Weekday()) - int(weekday) + 7) % 7
+		return last.AddDate(0, 0, -offset+(n+1)*7)
+	}
+	t := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	offset := (int(weekday) - int(t.Weekday()) + 7) % 7
+	return t.AddDate(0, 0, offset+(n-1)*7)
+}
+
+// 復活祭(グレゴリオ暦)の日付
+func easter(year int) time.Time {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+}
+
+// 土曜日の祝日は前の金曜日、日曜日の祝日は次の月曜日に振り替える
+func observed(t time.Time) time.Time {
+	switch t.Weekday() {
+	case time.Saturday:
+		return t.AddDate(0, 0, -1)
+	case time.Sunday:
+		return t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// 一年分のNYSEの休業日(土日を除く)を返す
+// 元日は土曜日の場合に前年の大晦日へ振り替えない
+func nyseHolidays(year int) map[string]bool {
+	holidays := make(map[string]bool)
+	add := func(t time.Time) {
+		holidays[t.Format("2006/01/02")] = true
+	}
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(year, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	if newYear := date(time.January, 1); newYear.Weekday() != time.Saturday {
+		add(observed(newYear)) // New Year's Day
+	}
+	if year >= 1998 {
+		add(nthWeekday(year, time.January, time.Monday, 3)) // Martin Luther King Jr. Day
+	}
+	add(nthWeekday(year, time.February, time.Monday, 3)) // Washington's Birthday
+	add(easter(year).AddDate(0, 0, -2))                  // Good Friday
+	add(nthWeekday(year, time.May, time.Monday, -1))     // Memorial Day
+	if year >= 2022 {
+		add(observed(date(time.June, 19))) // Juneteenth
+	}
+	add(observed(date(time.July, 4)))                      // Independence Day
+	add(nthWeekday(year, time.September, time.Monday, 1))  // Labor Day
+	add(nthWeekday(year, time.November, time.Thursday, 4)) // Thanksgiving Day
+	add(observed(date(time.December, 25)))                 // Christmas Day
+
+	prefix := fmt.Sprintf("%d/", year)
+	for _, d := range nyseSpecialClosures {
+		if strings.HasPrefix(d, prefix) {
+			holidays[d] = true
+		}
+	}
+	return holidays
+}
+
+// 取引所ごとのカレンダーと銘柄ごとの取引所の対応
+type calendarRegistry struct {
+	Default     *tradingCalendar            // 取引所の指定がない銘柄のカレンダー(JPX)
+	calendars   map[string]*tradingCalendar // {"NYSE": NYSEのカレンダー}のような取引所ごとのカレンダー
+	instruments map[string]string           // {"1306": "JPX"}のような銘柄ごとの取引所
+}
+
+// JPXとNYSEのカレンダーと、CODE_SHEETIDのinstrumentシートにある銘柄ごとの取引所を読み込む
+// instrumentシートにない銘柄はJPXの銘柄として扱う
+func getCalendarRegistry(r *http.Request, srv *sheets.Service, db *sql.DB) *calendarRegistry {
+	ctx := appengine.NewContext(r)
+
+	jpxCal := getTradingCalendar(r, srv, db)
+	nyseCal := newTradingCalendar(nyse, loadLocation(r, "America/New_York"), getHolidays(r, srv, db, nyse))
+	g := &calendarRegistry{
+		Default:     jpxCal,
+		calendars:   map[string]*tradingCalendar{jpx: jpxCal, nyse: nyseCal},
+		instruments: make(map[string]string),
+	}
+
+	// sheetには「銘柄, 取引所」の形式で一行ずつ並んでいることを想定している
+	// JPXの銘柄しか扱わない場合はsheetがなくてもよい
+	for _, row := range getOptionalSheetData(r, srv, codeSheetID, "instrument") {
+		if len(row) < 2 {
+			continue
+		}
+		code, ok1 := row[0].(string)
+		exchange, ok2 := row[1].(string)
+		if !ok1 || !ok2 || code == "" {
+			continue
+		}
+		exchange = strings.ToUpper(strings.TrimSpace(exchange))
+		if _, ok := g.calendars[exchange]; !ok {
+			log.Warningf(ctx, "unknown exchange. code: %s, exchange: %s", code, exchange)
+			continue
+		}
+		g.instruments[code] = exchange
+	}
+	log.Infof(ctx, "got calendars. instruments with exchange: %d", len(g.instruments))
+	return g
+}
+
+// 銘柄の取引所のカレンダー
+func (g *calendarRegistry) ForCode(code string) *tradingCalendar {
+	if c, ok := g.calendars[g.instruments[code]]; ok {
+		return c
+	}
+	return g.Default
+}
+
+// 銘柄の取引所のタイムゾーンで見た直近の取引日
+func (g *calendarRegistry) PreviousBussinessDay(code string) string {
+	c := g.ForCode(code)
+	return c.Prev(c.Now()).Format("2006/01/02")
+}
+
+// いずれかの取引所でtが取引日か
+// 日付を指定して計算し直すときに、どの取引所も休みの日を除くのに使う
+func (g *calendarRegistry) IsTradingDay(t time.Time) bool {
+	for _, c := range g.calendars {
+		if c.IsTradingDay(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// いずれかの取引所で前の日が取引日だったか
+// 全ての取引所が休みだった日の翌日は取得すべきデータがない
+func (g *calendarRegistry) PreviousDayOpen() bool {
+	for _, c := range g.calendars {
+		if c.PreviousDayOpen() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEaster(t *testing.T) {
+	tests := map[int]string{
+		2000: "2000/04/23",
+		2008: "2008/03/23",
+		2019: "2019/04/21",
+		2021: "2021/04/04",
+		2022: "2022/04/17",
+		2038: "2038/04/25",
+	}
+	for year, want := range tests {
+		if got := easter(year).Format("2006/01/02"); got != want {
+			t.Errorf("easter(%d) = %s, want %s", year, got, want)
+		}
+	}
+}
+
+func TestNthWeekday(t *testing.T) {
+	tests := []struct {
+		year    int
+		month   time.Month
+		weekday time.Weekday
+		n       int
+		want    string
+	}{
+		{2019, time.January, time.Monday, 3, "2019/01/21"},
+		{2019, time.November, time.Thursday, 4, "2019/11/28"},
+		{2019, time.May, time.Monday, -1, "2019/05/27"},
+		// 月の最後の日がその曜日の場合
+		{2021, time.May, time.Monday, -1, "2021/05/31"},
+		{2022, time.February, time.Monday, 3, "2022/02/21"},
+	}
+	for _, tt := range tests {
+		if got := nthWeekday(tt.year, tt.month, tt.weekday, tt.n).Format("2006/01/02"); got != tt.want {
+			t.Errorf("nthWeekday(%d, %v, %v, %d) = %s, want %s", tt.year, tt.month, tt.weekday, tt.n, got, tt.want)
+		}
+	}
+}
+
+// NYSEの公表している休業日(土日を除く)
+func TestNYSEHolidays(t *testing.T) {
+	tests := []struct {
+		year int
+		want []string
+	}{
+		{
+			// 元大統領の国葬による臨時の休業日
+			year: 2018,
+			want: []string{
+				"2018/01/01", "2018/01/15", "2018/02/19", "2018/03/30", "2018/05/28",
+				"2018/07/04", "2018/09/03", "2018/11/22", "2018/12/05", "2018/12/25",
+			},
+		},
+		{
+			year: 2019,
+			want: []string{
+				"2019/01/01", "2019/01/21", "2019/02/18", "2019/04/19", "2019/05/27",
+				"2019/07/04", "2019/09/02", "2019/11/28", "2019/12/25",
+			},
+		},
+		{
+			// 7/4(日)は翌日、12/25(土)は前日に振り替える. 2022/01/01(土)は前年の大晦日に振り替えない
+			year: 2021,
+			want: []string{
+				"2021/01/01", "2021/01/18", "2021/02/15", "2021/04/02", "2021/05/31",
+				"2021/07/05", "2021/09/06", "2021/11/25", "2021/12/24",
+			},
+		},
+		{
+			// Juneteenthは2022年から. 6/19(日)は翌日に振り替える
+			year: 2022,
+			want: []string{
+				"2022/01/17", "2022/02/21", "2022/04/15", "2022/05/30", "2022/06/20",
+				"2022/07/04", "2022/09/05", "2022/11/24", "2022/12/26",
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := weekdayHolidays(nyseHolidays(tt.year)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("nyseHolidays(%d) = %v, want %v", tt.year, got, tt.want)
+		}
+	}
+}
+
+// 2019年の規則で求めたJPXとNYSEのカレンダーと、1306はJPX、SPYはNYSE、VODは扱っていない取引所の銘柄
+func testCalendarRegistry() *calendarRegistry {
+	jpxCal := newTradingCalendar(jpx, time.UTC, jpxHolidays(2019))
+	nyseCal := newTradingCalendar(nyse, time.UTC, nyseHolidays(2019))
+	return &calendarRegistry{
+		Default:     jpxCal,
+		calendars:   map[string]*tradingCalendar{jpx: jpxCal, nyse: nyseCal},
+		instruments: map[string]string{"1306": jpx, "SPY": nyse, "VOD": "LSE"},
+	}
+}
+
+func TestForCode(t *testing.T) {
+	reg := testCalendarRegistry()
+	tests := map[string]string{
+		"1306": jpx,
+		"SPY":  nyse,
+		// instrumentシートにない銘柄や扱っていない取引所の銘柄はJPX
+		"1802": jpx,
+		"VOD":  jpx,
+	}
+	for code, want := range tests {
+		if got := reg.ForCode(code).Name; got != want {
+			t.Errorf("ForCode(%s) = %s, want %s", code, got, want)
+		}
+	}
+}
+
+func TestRegistryIsTradingDay(t *testing.T) {
+	reg := testCalendarRegistry()
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"2019/05/16", true},
+		// NYSEだけ休み
+		{"2019/07/04", true},
+		// JPXだけ休み
+		{"2019/07/15", true},
+		// どちらも休み
+		{"2019/01/01", false},
+		{"2019/05/18", false},
+	}
+	for _, tt := range tests {
+		d, _ := time.Parse("2006/01/02", tt.date)
+		if got := reg.IsTradingDay(d); got != tt.want {
+			t.Errorf("IsTradingDay(%s) = %v, want %v", tt.date, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+// 指数に対する銘柄ごとの相対力とベータ、相関係数の計算をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// ベータと相関係数を求める日数
+	betaDays = 60
+	// 相対力を求めるのに必要な日数. 6ヶ月分の126日の前日まで
+	relativeHistoryDays = 127
+)
+
+// 相対力を求める期間(取引日数)
+// relativesテーブルとrelativeInfoの項目はこの順番に対応させる
+var relativeLookbacks = []int{21, 63, 126}
+
+// relativesテーブルの項目名
+var relativeColumns = []string{"code", "date", "rs1m", "rs3m", "rs6m", "rank1m", "rank3m", "rank6m", "beta60", "corr60"}
+
+// 指数に対する相対力とその順位、ベータ、相関係数
+type relativeInfo struct {
+	RS1M   float64 // 1ヶ月(21日)の指数に対する相対力(%). 銘柄の騰落率 / 指数の騰落率 - 1
+	RS3M   float64 // 3ヶ月(63日)の相対力(%)
+	RS6M   float64 // 6ヶ月(126日)の相対力(%)
+	Rank1M int     // RS1Mの全銘柄の中での順位(1が最も強い)
+	Rank3M int
+	Rank6M int
+	Beta60 float64 // 60日の日次騰落率による指数に対するベータ
+	Corr60 float64 // 60日の日次騰落率による指数との相関係数
+}
+
+// 銘柄ごとの相対力の計算結果
+type relativeResult struct {
+	Code string
+	Info relativeInfo
+}
+
+// 指数の終値を日付をキーにして返す
+// INDEX_CSVが指定されていればそのCSV(「2019/05/16,1500.5」の形式)から、なければdailyのINDEX_CODEの銘柄から読み込む
+func getIndexCloses(r *http.Request, db *sql.DB, date string) (map[string]float64, error) {
+	if path := os.Getenv("INDEX_CSV"); path != "" {
+		return readIndexCSV(path)
+	}
+	code := os.Getenv("INDEX_CODE")
+	if code == "" {
+		return nil, fmt.Errorf("INDEX_CODE or INDEX_CSV must be set")
+	}
+	dcs, err := getOrderedDateCloses(r, db, code, date, relativeHistoryDays)
+	if err != nil {
+		return nil, fmt.Errorf("failed to getOrderedDateCloses. index code: %s, %v", code, err)
+	}
+	closes := make(map[string]float64)
+	for _, dc := range dcs {
+		closes[dc.Date] = dc.Close
+	}
+	return closes, nil
+}
+
+// 指数のCSVを読み込む. 終値が数値でない行(見出しなど)は読み飛ばす
+func readIndexCSV(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s. %v", path, err)
+	}
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s. %v", path, err)
+	}
+	closes := make(map[string]float64)
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		c, err := strconv.ParseFloat(row[1], 64)
+		if err != nil {
+			continue
+		}
+		closes[row[0]] = c
+	}
+	return closes, nil
+}
+
+// 直近の日付順の終値と指数の終値から相対力、ベータ、相関係数を求める
+// 指数の終値がない日付は除いて、銘柄と指数の両方がある日だけで計算する
+func calcRelative(dcs []dateClose, index map[string]float64) (relativeInfo, error) {
+	var cs, is []float64
+	for _, dc := range dcs {
+		if ic, ok := index[dc.Date]; ok && ic != 0 && dc.Close != 0 {
+			cs = append(cs, dc.Close)
+			is = append(is, ic)
+		}
+	}
+	if len(cs) <= relativeLookbacks[len(relativeLookbacks)-1] {
+		return relativeInfo{}, fmt.Errorf("not enough data. %d days", len(cs))
+	}
+
+	var rs [3]float64
+	for i, l := range relativeLookbacks {
+		rs[i] = ((cs[0]/cs[l])/(is[0]/is[l]) - 1) * 100
+	}
+
+	// 日次騰落率から共分散と分散を求める
+	var cr, ir []float64
+	for i := 0; i < betaDays && i+1 < len(cs); i++ {
+		cr = append(cr, cs[i]/cs[i+1]-1)
+		ir = append(ir, is[i]/is[i+1]-1)
+	}
+	cm, im := mean(cr), mean(ir)
+	var cov, cvar, ivar float64
+	for i := range cr {
+		cov += (cr[i] - cm) * (ir[i] - im)
+		cvar += (cr[i] - cm) * (cr[i] - cm)
+		ivar += (ir[i] - im) * (ir[i] - im)
+	}
+	info := relativeInfo{RS1M: rs[0], RS3M: rs[1], RS6M: rs[2]}
+	if ivar != 0 {
+		info.Beta60 = cov / ivar
+	}
+	if cvar != 0 && ivar != 0 {
+		info.Corr60 = cov / math.Sqrt(cvar*ivar)
+	}
+	return info, nil
+}
+
+// 平均を返す. 空の場合は0
+func mean(vs []float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range vs {
+		sum += v
+	}
+	return sum / float64(len(vs))
+}
+
+// 相対力の期間ごとに全銘柄の中での順位をつける
+func rankRelatives(results []relativeResult) {
+	rank1m := rankBy(results, func(i relativeInfo) float64 { return i.RS1M })
+	rank3m := rankBy(results, func(i relativeInfo) float64 { return i.RS3M })
+	rank6m := rankBy(results, func(i relativeInfo) float64 { return i.RS6M })
+	for i := range results {
+		results[i].Info.Rank1M, results[i].Info.Rank3M, results[i].Info.Rank6M = rank1m[i], rank3m[i], rank6m[i]
+	}
+}
+
+// resultsの並びに対応する、rsの大きい順の順位を返す
+func rankBy(results []relativeResult, rs func(relativeInfo) float64) []int {
+	idx := make([]int, len(results))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return rs(results[idx[a]].Info) > rs(results[idx[b]].Info)
+	})
+	ranks := make([]int, len(results))
+	for n, i := range idx {
+		ranks[i] = n + 1
+	}
+	return ranks
+}
+
+// 全銘柄の指数に対する相対力、ベータ、相関係数を計算してrelativesテーブルに書き込むHandler
+// /relative?date=2019/05/16 のように日付を指定した場合はその日付で計算し直す
+func relativeHandler(w http.ResponseWriter, r *http.Request) {
+	processStartTime := time.Now().UTC()
+	// GAE log
+	ctx := appengine.NewContext(r)
+
+	// get environment var, sheet, db
+	sheet, db, err := initialize(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to initialize. err: %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to initialize. got environment var, sheet, db.")
+
+	// 休日データを取得
+	cal := getTradingCalendar(r, sheet, db)
+	now := cal.Now()
+
+	// test環境ではデータの存在する最新の日付に合わせる
+	previousBussinessDay := "2019/05/16"
+	date, err := getDateParam(r, "date")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if date != "" {
+		previousBussinessDay = date
+	} else if runEnv != "test" {
+		// 前の日が休みの日だったら計算するデータがないので起動しない
+		if !cal.PreviousDayOpen() {
+			log.Infof(ctx, "Previous day is not business day.")
+			return
+		}
+		previousBussinessDay = cal.Prev(now).Format("2006/01/02")
+	}
+	log.Infof(ctx, "previous BussinessDay %s", previousBussinessDay)
+
+	index, err := getIndexCloses(r, db, previousBussinessDay)
+	if err != nil {
+		log.Errorf(ctx, "failed to getIndexCloses. %v", err)
+		os.Exit(0)
+	}
+
+	codes, err := selectLatestCodes(r, db)
+	if err != nil {
+		log.Errorf(ctx, "failed to selectLatestCodes %v", err)
+		os.Exit(0)
+	}
+
+	var results []relativeResult
+	for _, code := range codes {
+		dcs, err := getOrderedDateCloses(r, db, code, previousBussinessDay, relativeHistoryDays)
+		if err != nil {
+			log.Warningf(ctx, "failed to getOrderedDateCloses. code: %s, err: %v", code, err)
+			continue
+		}
+		info, err := calcRelative(dcs, index)
+		if err != nil {
+			log.Warningf(ctx, "failed to calcRelative. code: %s, err: %v", code, err)
+			continue
+		}
+		results = append(results, relativeResult{code, info})
+	}
+	// 順位は計算できた銘柄の中でつける
+	rankRelatives(results)
+
+	// 一度に大量に書き込まないようにMAX_SQL_INSERT件ずつ書き込む
+	maxInsert, err := strconv.Atoi(mustGetenv(r, "MAX_SQL_INSERT"))
+	if err != nil {
+		log.Errorf(ctx, "failed to get MAX_SQL_INSERT. %v", err)
+		os.Exit(0)
+	}
+	for begin := 0; begin < len(results); begin += maxInsert {
+		end := begin + maxInsert
+		if end > len(results) {
+			end = len(results)
+		}
+		var records [][]string
+		for _, res := range results[begin:end] {
+			i := res.Info
+			records = append(records, []string{res.Code, previousBussinessDay,
+				fmt.Sprintf("%f", i.RS1M), fmt.Sprintf("%f", i.RS3M), fmt.Sprintf("%f", i.RS6M),
+				strconv.Itoa(i.Rank1M), strconv.Itoa(i.Rank3M), strconv.Itoa(i.Rank6M),
+				fmt.Sprintf("%f", i.Beta60), fmt.Sprintf("%f", i.Corr60)})
+		}
+		if _, err := replaceDB(r, db, "relatives", relativeColumns, records); err != nil {
+			log.Errorf(ctx, "failed to replaceDB. %v", err)
+			os.Exit(0)
+		}
+	}
+	log.Infof(ctx, "succeeded to write relatives. codes: %d, calculated: %d", len(codes), len(results))
+	log.Infof(ctx, "done relativeHandler. Elapsed time %v.", time.Since(processStartTime))
+}
+
+// 銘柄コード、日付を渡すと該当のrelativeInfo structに対応する相対力の値を返す
+func getRelativeInfo(r *http.Request, db *sql.DB, code string, date string) (relativeInfo, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT rs1m, rs3m, rs6m, rank1m, rank3m, rank6m, beta60, corr60 FROM relatives WHERE code = %s and date = '%s';",
+		code, date))
+	if err != nil {
+		return relativeInfo{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(ret) != 8 {
+		return relativeInfo{}, fmt.Errorf("no selected data")
+	}
+
+	var fs [5]float64
+	for i, k := range []int{0, 1, 2, 6, 7} {
+		if fs[i], err = strconv.ParseFloat(ret[k], 64); err != nil {
+			return relativeInfo{}, fmt.Errorf("failed to ParseFloat %v", err)
+		}
+	}
+	var ranks [3]int
+	for i := range ranks {
+		if ranks[i], err = strconv.Atoi(ret[3+i]); err != nil {
+			return relativeInfo{}, fmt.Errorf("failed to Atoi %v", err)
+		}
+	}
+	return relativeInfo{fs[0], fs[1], fs[2], ranks[0], ranks[1], ranks[2], fs[3], fs[4]}, nil
+}
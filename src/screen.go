@@ -0,0 +1,651 @@
+// marketInfoの項目に対する条件式(スクリーニング)の解釈と実行をこのコードにまとめる
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// 設定ファイルに書くスクリーニングの定義
+// 例: {"name": "ppp_kahanshin", "rule": "ppp == \"ppp\" && kahanshin && increasingRate > 1.02", "output": "sheet"}
+type screen struct {
+	Name   string `json:"name"`   // スクリーニング名. outputがsheetの場合は書き込み先のsheet名
+	Rule   string `json:"rule"`   // 条件式
+	Output string `json:"output"` // 出力先. "sheet" または "json"
+	Path   string `json:"path"`   // outputがjsonの場合の出力先ファイル. 指定がなければSINK_DIRの「name.json」
+	Sort   string `json:"sort"`   // 並び替えに使う項目名. 先頭に"-"をつけると降順. 指定がなければmarketシートと同じ順番
+}
+
+// 設定ファイルからスクリーニングの定義を読み込んで条件式を解釈できるか確認する
+// 定義に誤りのあるスクリーニングは除いて、その理由をinvalidで返す
+func loadScreens(path string) ([]screen, []error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	var all []screen
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	// 存在しない項目名を事前に見つけるために空のmarketInfoの項目名を使う
+	emptyFacts := getFacts(&marketInfo{})
+	var screens []screen
+	var invalid []error
+	for _, s := range all {
+		if err := s.validate(emptyFacts); err != nil {
+			invalid = append(invalid, err)
+			continue
+		}
+		screens = append(screens, s)
+	}
+	return screens, invalid, nil
+}
+
+// スクリーニングの定義に誤りがないか確認する
+func (s screen) validate(facts map[string]interface{}) error {
+	if s.Name == "" {
+		return fmt.Errorf("screen name is empty. rule: %s", s.Rule)
+	}
+	if s.Output != "sheet" && s.Output != "json" {
+		return fmt.Errorf("screen %s: output must be 'sheet' or 'json': '%s'", s.Name, s.Output)
+	}
+	// 一時ディレクトリに書き込んでもインスタンスが終われば消えるので出力先の指定を必須にする
+	if s.Output == "json" && s.Path == "" && os.Getenv("SINK_DIR") == "" {
+		return fmt.Errorf("screen %s: path or SINK_DIR is required for json output", s.Name)
+	}
+	e, err := parseRule(s.Rule)
+	if err != nil {
+		return fmt.Errorf("screen %s: %v", s.Name, err)
+	}
+	if err := checkIdents(e, facts); err != nil {
+		return fmt.Errorf("screen %s: %v", s.Name, err)
+	}
+	if s.Sort != "" {
+		if _, ok := facts[strings.TrimPrefix(s.Sort, "-")]; !ok {
+			return fmt.Errorf("screen %s: unknown sort field: '%s'", s.Name, s.Sort)
+		}
+	}
+	return nil
+}
+
+// SCREEN_CONFIGで指定された(指定がなければscreens.json)スクリーニングを全て実行し、
+// 条件に合う銘柄をそれぞれの出力先に書き込む
+// 定義に誤りのあるスクリーニングはログに出して飛ばし、残りは実行する
+func runScreens(r *http.Request, srv *sheets.Service, mis marketInfos) {
+	ctx := appengine.NewContext(r)
+
+	path := os.Getenv("SCREEN_CONFIG")
+	if path == "" {
+		path = "screens.json"
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		log.Infof(ctx, "no screen config: %s", path)
+		return
+	}
+	screens, invalid, err := loadScreens(path)
+	if err != nil {
+		log.Errorf(ctx, "failed to loadScreens. %v", err)
+		return
+	}
+	for _, err := range invalid {
+		log.Errorf(ctx, "skip invalid screen. %v", err)
+	}
+
+	for _, s := range screens {
+		matched, err := s.filter(mis)
+		if err != nil {
+			log.Errorf(ctx, "failed to filter screen %s. %v", s.Name, err)
+			continue
+		}
+		log.Infof(ctx, "screen %s matched %d codes", s.Name, len(matched))
+
+		switch s.Output {
+		case "sheet":
+			err = clearAndWriteSheet(srv, calcSheetID, s.Name, matched.Interface())
+		case "json":
+			err = s.writeJSON(matched)
+		}
+		if err != nil {
+			log.Errorf(ctx, "failed to write screen %s. %v", s.Name, err)
+		}
+	}
+}
+
+// 条件式に合うmarketInfoだけを返す
+// 条件式で使う項目が取得できなかった銘柄は条件に合わないものとして除く
+// sortの指定がなければ元の順番のまま
+func (s screen) filter(mis marketInfos) (marketInfos, error) {
+	e, err := parseRule(s.Rule)
+	if err != nil {
+		return nil, err
+	}
+	matched := marketInfos{}
+	var matchedFacts []map[string]interface{}
+	for i := range mis {
+		facts := mis[i].facts()
+		ok, err := evalBool(e, facts)
+		if _, missing := err.(missingFactError); missing {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("code: %s, %v", mis[i].Code, err)
+		}
+		if ok {
+			matched = append(matched, mis[i])
+			matchedFacts = append(matchedFacts, facts)
+		}
+	}
+	if s.Sort == "" {
+		return matched, nil
+	}
+
+	key := strings.TrimPrefix(s.Sort, "-")
+	desc := strings.HasPrefix(s.Sort, "-")
+	// marketInfoと項目のMapを同じ順番で並び替えるために添字を並び替える
+	idx := make([]int, len(matched))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		x, y := matchedFacts[idx[i]][key], matchedFacts[idx[j]][key]
+		if desc {
+			x, y = y, x
+		}
+		less, _ := compare("<", x, y)
+		return less
+	})
+	sorted := make(marketInfos, len(matched))
+	for i, k := range idx {
+		sorted[i] = matched[k]
+	}
+	return sorted, nil
+}
+
+// 条件式に合ったmarketInfoを項目名と値のMapの配列としてJSONファイルに書き込む
+func (s screen) writeJSON(mis marketInfos) error {
+	path := s.Path
+	if path == "" {
+		path = filepath.Join(os.Getenv("SINK_DIR"), s.Name+".json")
+	}
+	facts := make([]map[string]interface{}, 0, len(mis))
+	for i := range mis {
+		facts = append(facts, mis[i].facts())
+	}
+	data, err := json.MarshalIndent(facts, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// 任意の構造体、または構造体のポインタを引数にとって、
+// 条件式で使う項目名と値のMapを返す関数
+// 項目名はfactタグがあればそれを、なければフィールド名の先頭を小文字にしたものを使う(例: IncreasingRate -> increasingRate)
+// 値はStringメソッドがあれば文字列、数値はfloat64, boolはそのまま
+func getFacts(v interface{}) map[string]interface{} {
+	facts := make(map[string]interface{})
+	addFacts(reflect.ValueOf(v), facts)
+	return facts
+}
+
+func addFacts(rv reflect.Value, facts map[string]interface{}) {
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		// 小文字で始まるフィールドは条件式の項目にしない
+		if rt.Field(i).PkgPath != "" {
+			continue
+		}
+		fv := rv.Field(i)
+		name := rt.Field(i).Tag.Get("fact")
+		if name == "" {
+			name = lowerCamel(rt.Field(i).Name)
+		}
+		// Stringメソッドを持っている場合はそれを使う
+		if f := fv.MethodByName("String"); f.Kind() == reflect.Func {
+			facts[name] = f.Call(nil)[0].Interface()
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Struct:
+			// フィールドがstructの場合は再帰で同じMapに詰める
+			addFacts(fv, facts)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			facts[name] = float64(fv.Int())
+		case reflect.Float32, reflect.Float64:
+			facts[name] = fv.Float()
+		default:
+			facts[name] = fv.Interface()
+		}
+	}
+}
+
+// 取得できなかった項目の名前を記録する
+// vは項目をまとめた構造体のポインタ. 構造体の項目名を全て記録する
+func addMissingFacts(missing map[string]bool, v interface{}) {
+	for name := range getFacts(v) {
+		missing[name] = true
+	}
+}
+
+// marketInfoの条件式で使う項目名と値のMap
+// 取得できなかった項目の値はnilにする
+func (m *marketInfo) facts() map[string]interface{} {
+	facts := getFacts(m)
+	for name := range m.missing {
+		facts[name] = nil
+	}
+	return facts
+}
+
+// 先頭の大文字の並びを小文字にする
+// 例: PPP -> ppp, RSI14 -> rsi14, MACDSignal -> macdSignal
+func lowerCamel(s string) string {
+	rs := []rune(s)
+	n := 0
+	for n < len(rs) && unicode.IsUpper(rs[n]) {
+		n++
+	}
+	// 大文字の並びの後ろに小文字が続く場合、最後の大文字は次の単語の先頭
+	if n > 1 && n < len(rs) && unicode.IsLower(rs[n]) {
+		n--
+	}
+	if n == 0 {
+		n = 1
+	}
+	for i := 0; i < n; i++ {
+		rs[i] = unicode.ToLower(rs[i])
+	}
+	return string(rs)
+}
+
+// 条件式の構文木
+type ruleExpr interface {
+	eval(facts map[string]interface{}) (interface{}, error)
+}
+
+// 数値、文字列、true/falseの定数
+type ruleLiteral struct {
+	value interface{}
+}
+
+func (l ruleLiteral) eval(facts map[string]interface{}) (interface{}, error) {
+	return l.value, nil
+}
+
+// marketInfoの項目名
+type ruleIdent struct {
+	name string
+}
+
+// 条件式で使う項目の値が取得できなかった場合のエラー
+type missingFactError struct {
+	name string
+}
+
+func (e missingFactError) Error() string {
+	return fmt.Sprintf("missing field: '%s'", e.name)
+}
+
+func (id ruleIdent) eval(facts map[string]interface{}) (interface{}, error) {
+	v, ok := facts[id.name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field: '%s'", id.name)
+	}
+	if v == nil {
+		return nil, missingFactError{id.name}
+	}
+	return v, nil
+}
+
+// 否定 !x
+type ruleNot struct {
+	x ruleExpr
+}
+
+func (n ruleNot) eval(facts map[string]interface{}) (interface{}, error) {
+	b, err := evalBool(n.x, facts)
+	if err != nil {
+		return nil, err
+	}
+	return !b, nil
+}
+
+// 二項演算 x op y
+type ruleBinary struct {
+	op   string
+	x, y ruleExpr
+}
+
+func (b ruleBinary) eval(facts map[string]interface{}) (interface{}, error) {
+	// && と || は左側だけで結果が決まる場合は右側を評価しない
+	if b.op == "&&" || b.op == "||" {
+		x, err := evalBool(b.x, facts)
+		if err != nil {
+			return nil, err
+		}
+		if (b.op == "&&" && !x) || (b.op == "||" && x) {
+			return x, nil
+		}
+		return evalBool(b.y, facts)
+	}
+
+	x, err := b.x.eval(facts)
+	if err != nil {
+		return nil, err
+	}
+	y, err := b.y.eval(facts)
+	if err != nil {
+		return nil, err
+	}
+	return compare(b.op, x, y)
+}
+
+// 同じ型どうしの値を比較する
+// 数値と文字列は全ての比較演算子、boolは==と!=だけ使える
+func compare(op string, x interface{}, y interface{}) (bool, error) {
+	var c int
+	switch xv := x.(type) {
+	case float64:
+		yv, ok := y.(float64)
+		if !ok {
+			return false, fmt.Errorf("cannot compare %v with %v", x, y)
+		}
+		if xv < yv {
+			c = -1
+		} else if xv > yv {
+			c = 1
+		}
+	case string:
+		yv, ok := y.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot compare '%v' with %v", x, y)
+		}
+		c = strings.Compare(xv, yv)
+	case bool:
+		yv, ok := y.(bool)
+		if !ok || (op != "==" && op != "!=") {
+			return false, fmt.Errorf("cannot compare %v %s %v", x, op, y)
+		}
+		if xv != yv {
+			c = 1
+		}
+	default:
+		return false, fmt.Errorf("unsupported value: %v", x)
+	}
+
+	switch op {
+	case "==":
+		return c == 0, nil
+	case "!=":
+		return c != 0, nil
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	case ">=":
+		return c >= 0, nil
+	}
+	return false, fmt.Errorf("unknown operator: %s", op)
+}
+
+// 構文木の中の項目名が全てfactsにあるか確認する
+func checkIdents(e ruleExpr, facts map[string]interface{}) error {
+	switch v := e.(type) {
+	case ruleIdent:
+		_, err := v.eval(facts)
+		return err
+	case ruleNot:
+		return checkIdents(v.x, facts)
+	case ruleBinary:
+		if err := checkIdents(v.x, facts); err != nil {
+			return err
+		}
+		return checkIdents(v.y, facts)
+	}
+	return nil
+}
+
+// 評価結果がboolであることを確認して返す
+func evalBool(e ruleExpr, facts map[string]interface{}) (bool, error) {
+	v, err := e.eval(facts)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("not a boolean: %v", v)
+	}
+	return b, nil
+}
+
+// 条件式の字句
+type ruleToken struct {
+	kind  string // "num", "str", "ident", "op", "eof"
+	value string
+}
+
+// 条件式を字句に分ける
+func tokenizeRule(rule string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	rs := []rune(rule)
+	for i := 0; i < len(rs); {
+		c := rs[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.' || isNegativeNumber(rs, i, tokens):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{"num", string(rs[i:j])})
+			i = j
+		case c == '"':
+			j := i + 1
+			for j < len(rs) && rs[j] != '"' {
+				j++
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string in rule: %s", rule)
+			}
+			tokens = append(tokens, ruleToken{"str", string(rs[i+1 : j])})
+			i = j + 1
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, ruleToken{"ident", string(rs[i:j])})
+			i = j
+		default:
+			// 2文字の演算子を先に見る
+			if i+1 < len(rs) {
+				two := string(rs[i : i+2])
+				switch two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					tokens = append(tokens, ruleToken{"op", two})
+					i += 2
+					continue
+				}
+			}
+			switch c {
+			case '<', '>', '!', '(', ')':
+				tokens = append(tokens, ruleToken{"op", string(c)})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character '%c' in rule: %s", c, rule)
+			}
+		}
+	}
+	return append(tokens, ruleToken{"eof", ""}), nil
+}
+
+// 位置iの「-」が負の数の符号か
+// 値や「)」の後ろの「-」は符号ではない
+func isNegativeNumber(rs []rune, i int, tokens []ruleToken) bool {
+	if rs[i] != '-' || i+1 >= len(rs) || !(unicode.IsDigit(rs[i+1]) || rs[i+1] == '.') {
+		return false
+	}
+	if len(tokens) == 0 {
+		return true
+	}
+	prev := tokens[len(tokens)-1]
+	return prev.kind == "op" && prev.value != ")"
+}
+
+// 条件式の構文解析器
+// expr    := and ("||" and)*
+// and     := not ("&&" not)*
+// not     := "!" not | compare
+// compare := primary (("==" | "!=" | "<" | "<=" | ">" | ">=") primary)?
+// primary := number | string | true | false | ident | "(" expr ")"
+// number  := "-"? digits ("." digits)?
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+// 条件式を構文木にする
+func parseRule(rule string) (ruleExpr, error) {
+	tokens, err := tokenizeRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	p := &ruleParser{tokens: tokens}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("unexpected '%s' in rule: %s", t.value, rule)
+	}
+	return e, nil
+}
+
+func (p *ruleParser) peek() ruleToken {
+	return p.tokens[p.pos]
+}
+
+func (p *ruleParser) next() ruleToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().value == "||" {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = ruleBinary{"||", x, y}
+	}
+	return x, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == "op" && p.peek().value == "&&" {
+		p.next()
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		x = ruleBinary{"&&", x, y}
+	}
+	return x, nil
+}
+
+func (p *ruleParser) parseNot() (ruleExpr, error) {
+	if p.peek().kind == "op" && p.peek().value == "!" {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return ruleNot{x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *ruleParser) parseCompare() (ruleExpr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == "op" {
+		switch t.value {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.next()
+			y, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return ruleBinary{t.value, x, y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *ruleParser) parsePrimary() (ruleExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case "num":
+		f, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s': %v", t.value, err)
+		}
+		return ruleLiteral{f}, nil
+	case "str":
+		return ruleLiteral{t.value}, nil
+	case "ident":
+		switch t.value {
+		case "true":
+			return ruleLiteral{true}, nil
+		case "false":
+			return ruleLiteral{false}, nil
+		}
+		return ruleIdent{t.value}, nil
+	case "op":
+		if t.value == "(" {
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if c := p.next(); c.kind != "op" || c.value != ")" {
+				return nil, fmt.Errorf("expected ')' but got '%s'", c.value)
+			}
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected '%s'", t.value)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRuleEval(t *testing.T) {
+	facts := map[string]interface{}{
+		"a": true, "b": false, "c": true,
+		"x": 3.0, "y": -2.0,
+		"ppp":   "semiPPP",
+		"rsi14": nil, // 取得できなかった項目
+	}
+	tests := []struct {
+		rule string
+		want bool
+	}{
+		{"a", true},
+		{"!a", false},
+		{"!!a", true},
+		// &&は||より先に結びつく
+		{"a || b && false", true},
+		{"(a || b) && false", false},
+		{"b && c || a", true},
+		{"!b && a", true},
+		{"!(a && c)", false},
+		{"x > 2 && x <= 3", true},
+		{"x >= 3.5", false},
+		{"x != 3", false},
+		{"x == 3.0", true},
+		{"y == -2", true},
+		{"y < -1.5", true},
+		{"(-2 == y)", true},
+		{"ppp == \"semiPPP\"", true},
+		{"ppp != \"ppp\"", true},
+		{"ppp > \"ppp\"", true},
+		{"a == true", true},
+		{"b != false", false},
+		// 左側だけで結果が決まる場合は右側の取得できなかった項目を評価しない
+		{"a || rsi14 < 30", true},
+		{"b && rsi14 < 30", false},
+	}
+	for _, tt := range tests {
+		e, err := parseRule(tt.rule)
+		if err != nil {
+			t.Errorf("parseRule(%q) error: %v", tt.rule, err)
+			continue
+		}
+		got, err := evalBool(e, facts)
+		if err != nil {
+			t.Errorf("eval(%q) error: %v", tt.rule, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("eval(%q) = %v, want %v", tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestParseRuleError(t *testing.T) {
+	tests := []struct {
+		rule string
+		want string
+	}{
+		{"x # 1", "unexpected character '#'"},
+		{"x - 1", "unexpected character '-'"},
+		{"ppp == \"ppp", "unterminated string"},
+		{"(a && b", "expected ')'"},
+		{"a && b)", "unexpected ')'"},
+		{"a &&", "unexpected ''"},
+		{"x > 1.2.3", "invalid number"},
+		{"", "unexpected ''"},
+	}
+	for _, tt := range tests {
+		_, err := parseRule(tt.rule)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseRule(%q) error = %v, want %q", tt.rule, err, tt.want)
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	facts := map[string]interface{}{"a": true, "x": 3.0, "ppp": "ppp", "rsi14": nil}
+	tests := []struct {
+		rule    string
+		want    string
+		missing bool
+	}{
+		{"unknown > 1", "unknown field: 'unknown'", false},
+		{"ppp > 1", "cannot compare", false},
+		{"x == \"3\"", "cannot compare", false},
+		{"a > false", "cannot compare", false},
+		{"x", "not a boolean", false},
+		{"x && a", "not a boolean", false},
+		{"rsi14 < 30", "missing field: 'rsi14'", true},
+	}
+	for _, tt := range tests {
+		e, err := parseRule(tt.rule)
+		if err != nil {
+			t.Errorf("parseRule(%q) error: %v", tt.rule, err)
+			continue
+		}
+		_, err = evalBool(e, facts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("eval(%q) error = %v, want %q", tt.rule, err, tt.want)
+			continue
+		}
+		if _, missing := err.(missingFactError); missing != tt.missing {
+			t.Errorf("eval(%q) missingFactError = %v, want %v", tt.rule, missing, tt.missing)
+		}
+	}
+}
+
+func TestCheckIdents(t *testing.T) {
+	facts := getFacts(&marketInfo{})
+	for _, rule := range []string{"ppp == \"ppp\" && kahanshin", "rsi14 < 30 || !(volumeRatio > 1.5)", "cross5x25DaysAgo == -1"} {
+		e, err := parseRule(rule)
+		if err != nil {
+			t.Fatalf("parseRule(%q) error: %v", rule, err)
+		}
+		if err := checkIdents(e, facts); err != nil {
+			t.Errorf("checkIdents(%q) error: %v", rule, err)
+		}
+	}
+	e, _ := parseRule("ppp == \"ppp\" && !(rsi15 < 30)")
+	if err := checkIdents(e, facts); err == nil || !strings.Contains(err.Error(), "rsi15") {
+		t.Errorf("checkIdents() error = %v, want unknown field rsi15", err)
+	}
+}
+
+func TestLowerCamel(t *testing.T) {
+	tests := map[string]string{
+		"PPP": "ppp", "RSI14": "rsi14", "MACDSignal": "macdSignal", "IncreasingRate": "increasingRate", "X": "x",
+	}
+	for in, want := range tests {
+		if got := lowerCamel(in); got != want {
+			t.Errorf("lowerCamel(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestScreenFilter(t *testing.T) {
+	mis := marketInfos{
+		{Code: "1001", PPPInfo: pppInfo{PPP: ppp}, VolumeInfo: volumeInfo{VolumeRatio: 1.2}},
+		{Code: "1002", PPPInfo: pppInfo{PPP: semiPPP}, VolumeInfo: volumeInfo{VolumeRatio: 3}},
+		{Code: "1003", PPPInfo: pppInfo{PPP: non}, VolumeInfo: volumeInfo{VolumeRatio: 5}},
+		{Code: "1004", PPPInfo: pppInfo{PPP: ppp}, VolumeInfo: volumeInfo{VolumeRatio: 2}},
+		// 売買高が取得できなかった銘柄は売買高を使う条件に合わない
+		{Code: "1005", PPPInfo: pppInfo{PPP: ppp}, missing: map[string]bool{"volumeRatio": true}},
+	}
+	tests := []struct {
+		name string
+		s    screen
+		want []string
+	}{
+		{"original order", screen{Rule: "ppp == \"ppp\" || ppp == \"semiPPP\""}, []string{"1001", "1002", "1004", "1005"}},
+		{"ascending", screen{Rule: "volumeRatio > 1", Sort: "volumeRatio"}, []string{"1001", "1004", "1002", "1003"}},
+		{"descending with - prefix", screen{Rule: "volumeRatio > 1", Sort: "-volumeRatio"}, []string{"1003", "1002", "1004", "1001"}},
+		{"skip missing fact", screen{Rule: "ppp == \"ppp\" && volumeRatio < 10", Sort: "-volumeRatio"}, []string{"1004", "1001"}},
+		{"no match", screen{Rule: "volumeRatio > 100"}, nil},
+	}
+	for _, tt := range tests {
+		matched, err := tt.s.filter(mis)
+		if err != nil {
+			t.Errorf("%s: filter() error: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, m := range matched {
+			got = append(got, m.Code)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: filter() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := (screen{Rule: "ppp > 1"}).filter(mis); err == nil {
+		t.Errorf("filter() with type mismatch: want error")
+	}
+}
+
+func TestLoadScreens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "screens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv("SINK_DIR", os.Getenv("SINK_DIR"))
+	os.Setenv("SINK_DIR", "")
+
+	path := filepath.Join(dir, "screens.json")
+	config := `[
+  {"name": "ok_sheet", "rule": "ppp == \"ppp\" && kahanshin", "output": "sheet", "sort": "-volumeRatio"},
+  {"name": "ok_json", "rule": "rsi14 < 30", "output": "json", "path": "/tmp/ok.json"},
+  {"name": "no_dir", "rule": "rsi14 < 30", "output": "json"},
+  {"name": "bad_output", "rule": "rsi14 < 30", "output": "mail"},
+  {"name": "bad_rule", "rule": "rsi14 <", "output": "sheet"},
+  {"name": "bad_ident", "rule": "rsi15 < 30", "output": "sheet"},
+  {"name": "bad_sort", "rule": "rsi14 < 30", "output": "sheet", "sort": "-unknown"},
+  {"name": "", "rule": "rsi14 < 30", "output": "sheet"}
+]`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	screens, invalid, err := loadScreens(path)
+	if err != nil {
+		t.Fatalf("loadScreens() error: %v", err)
+	}
+	var names []string
+	for _, s := range screens {
+		names = append(names, s.Name)
+	}
+	if want := []string{"ok_sheet", "ok_json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("loadScreens() = %v, want %v", names, want)
+	}
+	if len(invalid) != 6 {
+		t.Errorf("loadScreens() invalid = %v, want 6 errors", invalid)
+	}
+
+	// SINK_DIRがあればpathのないjsonのスクリーニングも使える
+	os.Setenv("SINK_DIR", dir)
+	if screens, _, _ = loadScreens(path); len(screens) != 3 {
+		t.Errorf("loadScreens() with SINK_DIR = %d screens, want 3", len(screens))
+	}
+
+	// 出荷する設定ファイルは全て有効
+	if screens, invalid, err = loadScreens("screens.json"); err != nil || len(invalid) != 0 || len(screens) == 0 {
+		t.Errorf("loadScreens(screens.json) = %d screens, invalid: %v, err: %v", len(screens), invalid, err)
+	}
+
+	if _, _, err := loadScreens(filepath.Join(dir, "none.json")); err == nil {
+		t.Errorf("loadScreens() with no file: want error")
+	}
+}
@@ -0,0 +1,133 @@
+// 東証33業種ごとにcalcHandlerの結果を集計して、強い業種の移り変わりを見られるようにする
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// sectorsテーブルの項目名
+var sectorColumns = []string{"date", "sector", "members", "avgreturn", "avgrs1m", "pppshare", "kahanshincount",
+	"returnrank", "strengthrank"}
+
+// 一日分の業種ごとの集計
+type sectorStat struct {
+	Date           string
+	Sector         string  // 東証33業種
+	Members        int     // 集計した銘柄数
+	AvgReturn      float64 // 前日比の騰落率の平均(%)
+	AvgRS1M        float64 // 指数に対する1ヶ月相対力の平均(%). 相対力が取得できなかった銘柄は除く
+	PPPShare       float64 // PPPの種類がpppかsemiPPPの銘柄の割合(%)
+	KahanshinCount int     // ローソク足の実体による下半身(bullish)の銘柄数
+	ReturnRank     int     // AvgReturnの業種の中での順位(1が最も強い)
+	StrengthRank   int     // PPPShareの業種の中での順位(1が最も強い). 同じ場合はAvgRS1Mの大きい方を上にする
+}
+
+// CODE_SHEETIDの'sector' sheetを読み取って、{"1802", "建設業"}のような銘柄コードと業種のMapを返す
+// sheetには銘柄コードと東証33業種の名前が一行ずつ並んでいることを想定している
+// 'sector' sheetはなくてもよく、ない場合は空のMapを返して業種の集計を行わない
+func getSectorsFromSheet(r *http.Request, srv *sheets.Service) map[string]string {
+	rows := getOptionalSheetData(r, srv, codeSheetID, "sector")
+	sectors := make(map[string]string)
+	for _, row := range rows {
+		if len(row) < 2 {
+			continue
+		}
+		code, ok1 := row[0].(string)
+		sector, ok2 := row[1].(string)
+		if !ok1 || !ok2 || sector == "" {
+			continue
+		}
+		sectors[code] = sector
+	}
+	return sectors
+}
+
+// marketInfosを業種ごとに集計して順位をつける
+// 業種のわからない銘柄は集計しない
+// 相対力が取得できなかった銘柄はAvgRS1Mの平均にだけ含めない
+func aggregateSectors(mis marketInfos, date string) []sectorStat {
+	statMap := make(map[string]*sectorStat)
+	pppCounts := make(map[string]int)
+	rsCounts := make(map[string]int)
+	for _, m := range mis {
+		if m.Sector == "" {
+			continue
+		}
+		s, ok := statMap[m.Sector]
+		if !ok {
+			s = &sectorStat{Date: date, Sector: m.Sector}
+			statMap[m.Sector] = s
+		}
+		s.Members++
+		s.AvgReturn += (m.IncreasingRateInfo.IncreasingRate - 1) * 100
+		if !m.missing[lowerCamel("RS1M")] {
+			s.AvgRS1M += m.RelativeInfo.RS1M
+			rsCounts[m.Sector]++
+		}
+		if m.PPPInfo.PPP >= semiPPP {
+			pppCounts[m.Sector]++
+		}
+		if m.KahanshinKind == bullishKahanshin {
+			s.KahanshinCount++
+		}
+	}
+
+	var stats []sectorStat
+	for name, s := range statMap {
+		s.AvgReturn /= float64(s.Members)
+		if rsCounts[name] > 0 {
+			s.AvgRS1M /= float64(rsCounts[name])
+		}
+		s.PPPShare = float64(pppCounts[name]) / float64(s.Members) * 100
+		stats = append(stats, *s)
+	}
+
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].AvgReturn > stats[j].AvgReturn
+	})
+	for i := range stats {
+		stats[i].ReturnRank = i + 1
+	}
+	// シートには強さの順に並べる
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].PPPShare != stats[j].PPPShare {
+			return stats[i].PPPShare > stats[j].PPPShare
+		}
+		return stats[i].AvgRS1M > stats[j].AvgRS1M
+	})
+	for i := range stats {
+		stats[i].StrengthRank = i + 1
+	}
+	return stats
+}
+
+// 業種ごとの集計をsectorsテーブルとsectorsシートに書き込む
+func writeSectors(r *http.Request, srv *sheets.Service, db *sql.DB, stats []sectorStat) error {
+	ctx := appengine.NewContext(r)
+
+	var records [][]string
+	sheetRecords := [][]interface{}{getColumnName(&sectorStat{})}
+	for i := range stats {
+		s := stats[i]
+		records = append(records, []string{s.Date, s.Sector, strconv.Itoa(s.Members),
+			fmt.Sprintf("%f", s.AvgReturn), fmt.Sprintf("%f", s.AvgRS1M), fmt.Sprintf("%f", s.PPPShare),
+			strconv.Itoa(s.KahanshinCount), strconv.Itoa(s.ReturnRank), strconv.Itoa(s.StrengthRank)})
+		sheetRecords = append(sheetRecords, toInterfaceSlice(&s))
+	}
+	if _, err := replaceDB(r, db, "sectors", sectorColumns, records); err != nil {
+		return fmt.Errorf("failed to replaceDB. %v", err)
+	}
+	if err := clearAndWriteSheet(srv, calcSheetID, "sectors", sheetRecords); err != nil {
+		return fmt.Errorf("failed to clearAndWriteSheet. %v", err)
+	}
+	log.Infof(ctx, "succeeded to write sectors. %d sectors", len(stats))
+	return nil
+}
@@ -73,6 +73,23 @@ func getSheetData(r *http.Request, srv *sheets.Service, sheetID string, readRang
 	}
 }
 
+// なくてもよいsheetを読み取る
+// sheetがない場合もエラーになるので、getSheetDataのように再試行せずに一度だけ読み取り、読み取れなければnilを返す
+func getOptionalSheetData(r *http.Request, srv *sheets.Service, sheetID string, readRange string) [][]interface{} {
+	ctx := appengine.NewContext(r)
+
+	resp, err := srv.Spreadsheets.Values.Get(sheetID, readRange).Do()
+	if err != nil {
+		log.Infof(ctx, "no data in optional sheet: %s. %v", readRange, err)
+		return nil
+	}
+	if status := resp.ServerResponse.HTTPStatusCode; status != 200 {
+		log.Infof(ctx, "no data in optional sheet: %s. HTTPstatus: %v", readRange, status)
+		return nil
+	}
+	return resp.Values
+}
+
 func clearSheet(srv *sheets.Service, sid string, sname string) error {
 	// clear stockprice rate spreadsheet:
 	resp, err := srv.Spreadsheets.Values.Clear(sid, sname, &sheets.ClearValuesRequest{}).Do()
@@ -105,41 +122,29 @@ func writeSheet(srv *sheets.Service, sid string, sname string, records [][]inter
 	return nil
 }
 
-// TODO: writeSheetにあとで置き換える
-func writeRate(srv *sheets.Service, r *http.Request, rate []codeRate, sid string, sname string) {
-	ctx := appengine.NewContext(r)
-
-	// spreadsheetに書き込み対象の行列を作成
-	matrix := make([][]interface{}, len(rate))
-	// 株価の比率順にソートしたものを書き込み
-	//for i, r := range rate {
-	//matrix[i] = []interface{}{r.Code, r.Rate[0], r.Rate[1], r.Rate[2], r.Rate[3], r.Rate[4], r.Rate[5]}
-	//}
+// 銘柄ごとの株価の比率を先頭行が項目名の表にする
+// 比率の項目名は直近から順にRate1, Rate2...
+func rateTable(rate []codeRate) [][]interface{} {
+	n := 0
 	for _, r := range rate {
-		m := make([]interface{}, 0)
-		m = append(m, r.Code)
+		if len(r.Rate) > n {
+			n = len(r.Rate)
+		}
+	}
+	header := []interface{}{"Code"}
+	for i := 1; i <= n; i++ {
+		header = append(header, fmt.Sprintf("Rate%d", i))
+	}
+	matrix := [][]interface{}{header}
+	for _, r := range rate {
+		m := []interface{}{r.Code}
 		// Rateの個数だけ書き込み
 		for i := 0; i < len(r.Rate); i++ {
 			m = append(m, r.Rate[i])
 		}
 		matrix = append(matrix, m)
 	}
-
-	valueRange := &sheets.ValueRange{
-		MajorDimension: "ROWS",
-		Values:         matrix,
-	}
-	// Write stockprice rate spreadsheet:
-	resp, err := srv.Spreadsheets.Values.Append(sid, sname, valueRange).ValueInputOption("USER_ENTERED").InsertDataOption("INSERT_ROWS").Do()
-	if err != nil {
-		log.Errorf(ctx, "Unable to write value. %v", err)
-		return
-	}
-	status := resp.ServerResponse.HTTPStatusCode
-	if status != 200 {
-		log.Errorf(ctx, "HTTPstatus error. %v", status)
-		return
-	}
+	return matrix
 }
 
 // SheetのClearとWriteを行う関数
@@ -154,3 +159,119 @@ func clearAndWriteSheet(srv *sheets.Service, sid string, sname string, records [
 	}
 	return nil
 }
+
+// 書き込み中の内容を置くsheet名と、一つ前の内容を残すsheet名の接尾辞
+const (
+	stagingSheetSuffix = "_staging"
+	prevSheetSuffix    = "_prev"
+)
+
+// spreadsheetにある全てのsheetの{sheet名: sheetのプロパティ}のMapを返す
+func getSheetProperties(srv *sheets.Service, sid string) (map[string]*sheets.SheetProperties, error) {
+	resp, err := srv.Spreadsheets.Get(sid).Fields("sheets.properties").Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get spreadsheet. %v", err)
+	}
+	status := resp.ServerResponse.HTTPStatusCode
+	if status != 200 {
+		return nil, fmt.Errorf("HTTPstatus error. %v", status)
+	}
+	props := make(map[string]*sheets.SheetProperties)
+	for _, s := range resp.Sheets {
+		props[s.Properties.Title] = s.Properties
+	}
+	return props, nil
+}
+
+// batchUpdateでsheetの追加、削除、名前の変更などをまとめて行う
+// まとめたリクエストは全て反映されるか、全て反映されないかのどちらかになる
+func batchUpdateSheet(srv *sheets.Service, sid string, requests []*sheets.Request) (*sheets.BatchUpdateSpreadsheetResponse, error) {
+	resp, err := srv.Spreadsheets.BatchUpdate(sid, &sheets.BatchUpdateSpreadsheetRequest{Requests: requests}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to batchUpdate. %v", err)
+	}
+	status := resp.ServerResponse.HTTPStatusCode
+	if status != 200 {
+		return nil, fmt.Errorf("HTTPstatus error. %v", status)
+	}
+	return resp, nil
+}
+
+// sheetを削除するリクエスト
+// SheetIdが0(最初のsheet)でも送られるようにForceSendFieldsを指定する
+func deleteSheetRequest(sheetID int64) *sheets.Request {
+	return &sheets.Request{DeleteSheet: &sheets.DeleteSheetRequest{SheetId: sheetID, ForceSendFields: []string{"SheetId"}}}
+}
+
+// sheetの名前を変えるリクエスト
+func renameSheetRequest(sheetID int64, title string) *sheets.Request {
+	return &sheets.Request{UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+		Properties: &sheets.SheetProperties{SheetId: sheetID, Title: title, ForceSendFields: []string{"SheetId"}},
+		Fields:     "title",
+	}}
+}
+
+// sheet全体の範囲
+// SheetIdが0(最初のsheet)でも送られるようにForceSendFieldsを指定する
+func sheetRange(sheetID int64) *sheets.GridRange {
+	return &sheets.GridRange{SheetId: sheetID, ForceSendFields: []string{"SheetId"}}
+}
+
+// sheetの内容を途中の状態が見えないように入れ替える
+// 1. 「sname_staging」sheetを作って書き込む. 書き込みに失敗した場合は削除して、snameのsheetはそのまま残す
+// 2. 一つのbatchUpdateで「sname_prev」を削除してsnameを「sname_prev」に複製し、snameの値を消して「sname_staging」の内容を貼り付け、「sname_staging」を削除する
+// snameのsheet自体は入れ替えないので、sheetIdも他のsheetからの参照もそのまま変わらない
+func replaceSheet(srv *sheets.Service, sid string, sname string, records [][]interface{}) error {
+	staging, prev := sname+stagingSheetSuffix, sname+prevSheetSuffix
+
+	props, err := getSheetProperties(srv, sid)
+	if err != nil {
+		return fmt.Errorf("failed to getSheetProperties. sheetID: %s, %v", sid, err)
+	}
+
+	// 前回失敗して残っているstagingのsheetは削除してから作り直す
+	var requests []*sheets.Request
+	if p, ok := props[staging]; ok {
+		requests = append(requests, deleteSheetRequest(p.SheetId))
+	}
+	requests = append(requests, &sheets.Request{AddSheet: &sheets.AddSheetRequest{Properties: &sheets.SheetProperties{Title: staging}}})
+	resp, err := batchUpdateSheet(srv, sid, requests)
+	if err != nil {
+		return fmt.Errorf("failed to add sheet. sheetID: %s, sheetName: %s, %v", sid, staging, err)
+	}
+	added := resp.Replies[len(resp.Replies)-1].AddSheet.Properties
+
+	if err := writeSheet(srv, sid, staging, records); err != nil {
+		if _, derr := batchUpdateSheet(srv, sid, []*sheets.Request{deleteSheetRequest(added.SheetId)}); derr != nil {
+			return fmt.Errorf("failed to writeSheet. sheetName: %s, %v. and failed to delete it. %v", staging, err, derr)
+		}
+		return fmt.Errorf("failed to writeSheet. sheetID: %s, sheetName: %s, %v", sid, staging, err)
+	}
+
+	// snameのsheetがまだない場合は、stagingのsheetの名前を変えてsnameにする
+	cur, ok := props[sname]
+	if !ok {
+		if _, err := batchUpdateSheet(srv, sid, []*sheets.Request{renameSheetRequest(added.SheetId, sname)}); err != nil {
+			return fmt.Errorf("failed to rename sheet. sheetID: %s, sheetName: %s, %v", sid, staging, err)
+		}
+		return nil
+	}
+
+	requests = nil
+	if p, ok := props[prev]; ok {
+		requests = append(requests, deleteSheetRequest(p.SheetId))
+	}
+	requests = append(requests,
+		&sheets.Request{DuplicateSheet: &sheets.DuplicateSheetRequest{
+			SourceSheetId: cur.SheetId, NewSheetName: prev, ForceSendFields: []string{"SourceSheetId"}}},
+		// 前の内容の方が行が多い場合に残らないように、貼り付ける前に値を全て消す
+		&sheets.Request{UpdateCells: &sheets.UpdateCellsRequest{Range: sheetRange(cur.SheetId), Fields: "userEnteredValue"}},
+		&sheets.Request{CopyPaste: &sheets.CopyPasteRequest{
+			Source: sheetRange(added.SheetId), Destination: sheetRange(cur.SheetId), PasteType: "PASTE_NORMAL"}},
+		deleteSheetRequest(added.SheetId),
+	)
+	if _, err := batchUpdateSheet(srv, sid, requests); err != nil {
+		return fmt.Errorf("failed to swap sheet. sheetID: %s, sheetName: %s, %v", sid, sname, err)
+	}
+	return nil
+}
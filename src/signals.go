@@ -0,0 +1,212 @@
+// calcHandlerの結果をsignalsテーブルに残して、履歴を参照できるようにする
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// signalsテーブルの項目名
+var signalColumns = []string{"code", "date", "ppp", "moving5", "moving20", "moving60", "moving100",
+	"beforepreviousclose", "previousclose", "increasingrate", "kahanshin", "previousppp", "pppdays", "kahanshinkind"}
+
+// signalsテーブルの一行
+type signal struct {
+	Code                string  `json:"code"`
+	Date                string  `json:"date"`
+	PPP                 string  `json:"ppp"`
+	Moving5             float64 `json:"moving5"`
+	Moving20            float64 `json:"moving20"`
+	Moving60            float64 `json:"moving60"`
+	Moving100           float64 `json:"moving100"`
+	BeforePreviousClose float64 `json:"beforePreviousClose"`
+	PreviousClose       float64 `json:"previousClose"`
+	IncreasingRate      float64 `json:"increasingRate"`
+	Kahanshin           bool    `json:"kahanshin"`
+	PreviousPPP         string  `json:"previousPPP"`
+	PPPDays             int     `json:"pppDays"`
+	KahanshinKind       string  `json:"kahanshinKind"`
+}
+
+// 前の取引日からのPPPの種類の変化
+type pppTransitionInfo struct {
+	PreviousPPP   pppKind // 前の取引日のPPPの種類
+	PPPTransition string  // 変化があった場合は「semiPPP->ppp」の形式、なければ空
+	PPPDays       int     // 今のPPPの種類が何取引日続いているか
+}
+
+// 前の取引日のPPPの種類と連続日数
+type previousPPP struct {
+	PPP     pppKind
+	Days    int
+	Unknown bool // 前の取引日のsignalsも移動平均もなくPPPの種類がわからない
+}
+
+// marketInfoからsignalsテーブルに書き込むレコードを作る
+func (m *marketInfo) signalRecord() []string {
+	ms := m.PPPInfo.Movings
+	inc := m.IncreasingRateInfo
+	kahanshin := "0"
+	if m.KahanshinFlag {
+		kahanshin = "1"
+	}
+	return []string{m.Code, m.Date, m.PPPInfo.PPP.String(),
+		fmt.Sprintf("%f", ms.Moving5), fmt.Sprintf("%f", ms.Moving20), fmt.Sprintf("%f", ms.Moving60), fmt.Sprintf("%f", ms.Moving100),
+		fmt.Sprintf("%f", inc.BeforePreviousClose), fmt.Sprintf("%f", inc.PreviousClose), fmt.Sprintf("%f", inc.IncreasingRate),
+		kahanshin, m.PPPTransitionInfo.PreviousPPP.String(), strconv.Itoa(m.PPPTransitionInfo.PPPDays), m.KahanshinKind.String()}
+}
+
+// 指定した日付のsignalsから銘柄ごとのPPPの種類と連続日数を取得する
+func getPreviousPPPs(r *http.Request, db *sql.DB, date string) (map[string]previousPPP, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf("SELECT code, ppp, pppdays FROM signals WHERE date = '%s';", date))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+	prevs := make(map[string]previousPPP)
+	for i := 0; i+2 < len(ret); i += 3 {
+		p, err := parsePPPKind(ret[i+1])
+		if err != nil {
+			return nil, err
+		}
+		// pppdaysの項目を追加する前のレコードは空なので1日として扱う
+		days, err := strconv.Atoi(ret[i+2])
+		if err != nil {
+			days = 1
+		}
+		prevs[ret[i]] = previousPPP{PPP: p, Days: days}
+	}
+	return prevs, nil
+}
+
+// 今のPPPの種類と前の取引日のPPPの種類から変化と連続日数を求める
+// 前の取引日のPPPの種類がわからない場合は変化なしとして、連続日数は今日からの1日とする
+func calcPPPTransition(current pppKind, prev previousPPP) pppTransitionInfo {
+	if prev.Unknown {
+		return pppTransitionInfo{PreviousPPP: current, PPPDays: 1}
+	}
+	if current == prev.PPP {
+		return pppTransitionInfo{PreviousPPP: prev.PPP, PPPDays: prev.Days + 1}
+	}
+	return pppTransitionInfo{
+		PreviousPPP:   prev.PPP,
+		PPPTransition: fmt.Sprintf("%s->%s", prev.PPP, current),
+		PPPDays:       1,
+	}
+}
+
+// marketInfosをsignalsテーブルに書き込む
+// 同じ日付を計算し直した場合は上書きする
+func saveSignals(r *http.Request, db *sql.DB, mis marketInfos) error {
+	// 一度に大量に書き込まないようにMAX_SQL_INSERT件ずつ書き込む
+	maxInsert, err := strconv.Atoi(mustGetenv(r, "MAX_SQL_INSERT"))
+	if err != nil {
+		return fmt.Errorf("failed to get MAX_SQL_INSERT. %v", err)
+	}
+	for begin := 0; begin < len(mis); begin += maxInsert {
+		end := begin + maxInsert
+		if end > len(mis) {
+			end = len(mis)
+		}
+		var records [][]string
+		for i := begin; i < end; i++ {
+			records = append(records, mis[i].signalRecord())
+		}
+		if _, err := replaceDB(r, db, "signals", signalColumns, records); err != nil {
+			return fmt.Errorf("failed to replaceDB. %v", err)
+		}
+	}
+	return nil
+}
+
+// 銘柄ごとのsignalsの履歴をJSONで返すHandler
+// /signals?code=1802&from=2019/05/01&to=2019/05/16 のように指定する
+// from, toは省略できる
+func signalsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	// read environment values
+	getEnv(r)
+
+	code := r.FormValue("code")
+	if _, err := strconv.Atoi(code); err != nil {
+		http.Error(w, fmt.Sprintf("invalid code: '%s'", code), http.StatusBadRequest)
+		return
+	}
+	from, err := getDateParam(r, "from")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := getDateParam(r, "to")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// cloud sql(ローカルの場合はmysql)と接続
+	db, err := dialSQL(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to open db. err: %v", err)
+		http.Error(w, "failed to open db", http.StatusInternalServerError)
+		return
+	}
+
+	signals, err := getSignals(r, db, code, from, to)
+	if err != nil {
+		log.Errorf(ctx, "failed to getSignals. code: %s, err: %v", code, err)
+		http.Error(w, "failed to get signals", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(signals); err != nil {
+		log.Errorf(ctx, "failed to encode signals. %v", err)
+	}
+}
+
+// 銘柄コードと期間を渡すとsignalsの履歴を古い順に返す
+// from, toは指定しない場合は空
+func getSignals(r *http.Request, db *sql.DB, code string, from string, to string) ([]signal, error) {
+	cond := ""
+	if from != "" {
+		cond += fmt.Sprintf(" AND date >= '%s'", from)
+	}
+	if to != "" {
+		cond += fmt.Sprintf(" AND date <= '%s'", to)
+	}
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT %s FROM signals WHERE code = %s%s ORDER BY date;", strings.Join(signalColumns, ","), code, cond))
+	if err != nil {
+		return nil, fmt.Errorf("failed to selectTable %v", err)
+	}
+
+	n := len(signalColumns)
+	signals := make([]signal, 0, len(ret)/n)
+	for i := 0; i+n-1 < len(ret); i += n {
+		row := ret[i : i+n]
+		var fs [7]float64
+		for j := 0; j < 7; j++ {
+			f, err := strconv.ParseFloat(row[3+j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to ParseFloat. date: %s, %v", row[1], err)
+			}
+			fs[j] = f
+		}
+		signals = append(signals, signal{
+			Code: row[0], Date: row[1], PPP: row[2],
+			Moving5: fs[0], Moving20: fs[1], Moving60: fs[2], Moving100: fs[3],
+			BeforePreviousClose: fs[4], PreviousClose: fs[5], IncreasingRate: fs[6],
+			Kahanshin: row[10] == "1", PreviousPPP: row[11], KahanshinKind: row[13],
+		})
+		// pppdaysの項目を追加する前のレコードは0のまま
+		signals[len(signals)-1].PPPDays, _ = strconv.Atoi(row[12])
+	}
+	return signals, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestCalcPPPTransition(t *testing.T) {
+	tests := []struct {
+		name    string
+		current pppKind
+		prev    previousPPP
+		want    pppTransitionInfo
+	}{
+		{
+			name:    "unknown previous",
+			current: semiPPP,
+			prev:    previousPPP{Unknown: true},
+			want:    pppTransitionInfo{PreviousPPP: semiPPP, PPPDays: 1},
+		},
+		{
+			name:    "same kind continues",
+			current: ppp,
+			prev:    previousPPP{PPP: ppp, Days: 4},
+			want:    pppTransitionInfo{PreviousPPP: ppp, PPPDays: 5},
+		},
+		{
+			name:    "upgrade",
+			current: ppp,
+			prev:    previousPPP{PPP: semiPPP, Days: 3},
+			want:    pppTransitionInfo{PreviousPPP: semiPPP, PPPTransition: "semiPPP->ppp", PPPDays: 1},
+		},
+		{
+			name:    "downgrade to non",
+			current: non,
+			prev:    previousPPP{PPP: ppp, Days: 10},
+			want:    pppTransitionInfo{PreviousPPP: ppp, PPPTransition: "ppp->non", PPPDays: 1},
+		},
+		{
+			name:    "opposite kinds",
+			current: oppositePPP,
+			prev:    previousPPP{PPP: oppositeSemiPPP, Days: 2},
+			want:    pppTransitionInfo{PreviousPPP: oppositeSemiPPP, PPPTransition: "oppositeSemiPPP->oppositePPP", PPPDays: 1},
+		},
+	}
+	for _, tt := range tests {
+		if got := calcPPPTransition(tt.current, tt.prev); got != tt.want {
+			t.Errorf("%s: calcPPPTransition() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
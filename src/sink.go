@@ -0,0 +1,222 @@
+// 計算結果の表の出力先(Google Sheets, CSVファイル, JSONファイル, DBのテーブル)をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/api/sheets/v4"
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+// 計算結果の表の出力先
+// recordsの先頭行はgetColumnNameの項目名、以降の行はtoInterfaceSliceの値になっていることを想定している
+type sink interface {
+	// nameはsheet名、ファイル名(拡張子なし)、テーブル名のどれかとして使う
+	Write(name string, records [][]interface{}) error
+}
+
+// sheetIDのsheetを書き込み途中の状態が見えないように入れ替える. 一つ前の内容は「name_prev」sheetに残す
+// noHeaderがtrueの場合は先頭行の項目名を書き込まない
+type sheetSink struct {
+	srv      *sheets.Service
+	sheetID  string
+	noHeader bool
+}
+
+func (s sheetSink) Write(name string, records [][]interface{}) error {
+	if s.noHeader && len(records) > 0 {
+		records = records[1:]
+	}
+	return replaceSheet(s.srv, s.sheetID, name, records)
+}
+
+// dirに「name.csv」として書き込む
+type csvSink struct {
+	dir string
+}
+
+func (s csvSink) Write(name string, records [][]interface{}) error {
+	f, err := os.Create(filepath.Join(s.dir, name+".csv"))
+	if err != nil {
+		return fmt.Errorf("failed to create csv. %v", err)
+	}
+	defer f.Close()
+
+	cw := csv.NewWriter(f)
+	for _, record := range records {
+		cw.Write(toStrings(record))
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// dirに「name.json」として項目名と値のMapの配列を書き込む
+type jsonSink struct {
+	dir string
+}
+
+func (s jsonSink) Write(name string, records [][]interface{}) error {
+	rows := make([]map[string]interface{}, 0, len(records))
+	if len(records) > 0 {
+		columns := toStrings(records[0])
+		for _, record := range records[1:] {
+			row := make(map[string]interface{})
+			for i, v := range record {
+				if i < len(columns) {
+					row[columns[i]] = v
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	data, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+	return ioutil.WriteFile(filepath.Join(s.dir, name+".json"), data, 0644)
+}
+
+// nameのテーブルに上書きで書き込む
+// テーブルの項目名は先頭行の項目名を小文字にしたもの. テーブルはあらかじめ作っておく
+// ownedがtrueの場合はgetSinksで接続したdbなのでCloseで閉じる
+type dbSink struct {
+	r     *http.Request
+	db    *sql.DB
+	owned bool
+}
+
+func (s dbSink) Close() error {
+	if !s.owned {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s dbSink) Write(name string, records [][]interface{}) error {
+	if len(records) < 2 {
+		return nil
+	}
+	columns := toStrings(records[0])
+	for i := range columns {
+		columns[i] = strings.ToLower(columns[i])
+	}
+	// 一度に大量に書き込まないようにMAX_SQL_INSERT件ずつ書き込む
+	maxInsert, err := strconv.Atoi(mustGetenv(s.r, "MAX_SQL_INSERT"))
+	if err != nil {
+		return fmt.Errorf("failed to get MAX_SQL_INSERT. %v", err)
+	}
+	rows := records[1:]
+	for begin := 0; begin < len(rows); begin += maxInsert {
+		end := begin + maxInsert
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var values [][]string
+		for _, row := range rows[begin:end] {
+			// SQLの文字列を壊さないように引用符を除く
+			vs := toStrings(row)
+			for i := range vs {
+				vs[i] = strings.Replace(vs[i], "'", "", -1)
+			}
+			values = append(values, vs)
+		}
+		if _, err := replaceDB(s.r, s.db, name, columns, values); err != nil {
+			return fmt.Errorf("failed to replaceDB. table: %s, %v", name, err)
+		}
+	}
+	return nil
+}
+
+// interface{}型の値を文字列にする
+func toStrings(record []interface{}) []string {
+	ss := make([]string, len(record))
+	for i, v := range record {
+		ss[i] = fmt.Sprintf("%v", v)
+	}
+	return ss
+}
+
+// 「MARKET_SINKS」のようにjobごとの環境変数で指定された出力先を返す
+// 例: MARKET_SINKS: "sheet,csv,json,db". 指定がなければsheetだけ
+// csv, jsonの出力先ディレクトリはSINK_DIR. 一時ディレクトリはインスタンスが終われば消えるので指定を必須にする
+// sheetの場合はsheetIDに書き込む. rateシートは以前から項目名の行がないのでそのままにする
+// dbの場合にdbがnilなら接続する. 使い終わったらcloseSinksで閉じる
+func getSinks(r *http.Request, srv *sheets.Service, db *sql.DB, job string, sheetID string) ([]sink, error) {
+	ctx := appengine.NewContext(r)
+
+	names := os.Getenv(strings.ToUpper(job) + "_SINKS")
+	if names == "" {
+		names = "sheet"
+	}
+	dir := os.Getenv("SINK_DIR")
+
+	var sinks []sink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "sheet":
+			sinks = append(sinks, sheetSink{srv: srv, sheetID: sheetID, noHeader: job == "rate"})
+		case "csv", "json":
+			if dir == "" {
+				closeSinks(sinks)
+				return nil, fmt.Errorf("SINK_DIR is required for %s sink. job: %s", name, job)
+			}
+			if name == "csv" {
+				sinks = append(sinks, csvSink{dir: dir})
+			} else {
+				sinks = append(sinks, jsonSink{dir: dir})
+			}
+		case "db":
+			if db != nil {
+				sinks = append(sinks, dbSink{r: r, db: db})
+				continue
+			}
+			d, err := dialSQL(r)
+			if err != nil {
+				closeSinks(sinks)
+				return nil, fmt.Errorf("failed to dialSQL. %v", err)
+			}
+			sinks = append(sinks, dbSink{r: r, db: d, owned: true})
+		default:
+			closeSinks(sinks)
+			return nil, fmt.Errorf("unknown sink: '%s'. job: %s", name, job)
+		}
+	}
+	log.Infof(ctx, "sinks for %s: %s", job, names)
+	return sinks, nil
+}
+
+// getSinksで接続したものを閉じる
+func closeSinks(sinks []sink) {
+	for _, s := range sinks {
+		if c, ok := s.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// 全ての出力先に書き込む
+// 一つの出力先に失敗しても残りの出力先には書き込み、失敗したものをまとめて返す
+func writeSinks(sinks []sink, name string, records [][]interface{}) error {
+	var errs []string
+	for _, s := range sinks {
+		if err := s.Write(name, records); err != nil {
+			errs = append(errs, fmt.Sprintf("%T: %v", s, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to write %s. %s", name, strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -13,6 +13,12 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// *sql.DBと*sql.Txのどちらでも同じようにSELECTや書き込みができるようにする
+type sqlRunner interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 func dialSQL(r *http.Request) (*sql.DB, error) {
 	ctx := appengine.NewContext(r)
 
@@ -37,7 +43,18 @@ func dialSQL(r *http.Request) (*sql.DB, error) {
 }
 
 // insert対象のtable名、項目名、レコードを引数に取ってDBに書き込む
-func insertDB(r *http.Request, db *sql.DB, table string, columns []string, records [][]string) (int, error) {
+// 既にあるレコード(PRIMARY KEYが重複するもの)は書き換えない
+func insertDB(r *http.Request, db sqlRunner, table string, columns []string, records [][]string) (int, error) {
+	return writeDB(r, db, "INSERT IGNORE", table, columns, records)
+}
+
+// insertDBと同じだが既にあるレコードは上書きする
+func replaceDB(r *http.Request, db sqlRunner, table string, columns []string, records [][]string) (int, error) {
+	return writeDB(r, db, "REPLACE", table, columns, records)
+}
+
+// INSERT IGNORE INTO または REPLACE INTO でDBに書き込む
+func writeDB(r *http.Request, db sqlRunner, verb string, table string, columns []string, records [][]string) (int, error) {
 	ctx := appengine.NewContext(r)
 
 	// insert対象を組み立てる
@@ -59,10 +76,10 @@ func insertDB(r *http.Request, db *sql.DB, table string, columns []string, recor
 	// 挿入対象の件数
 	targetNum := len(records)
 
-	log.Infof(ctx, "trying to insert %d values to '%s' table.", targetNum, table)
+	log.Infof(ctx, "trying to write %d values to '%s' table. (%s)", targetNum, table, verb)
 	// INSERT IGNORE INTO 'table名' (項目名1, 項目名2...) VALUES (...), (...)の形
 	// queryを組み立て
-	query := fmt.Sprintf("INSERT IGNORE INTO %s (", table)
+	query := fmt.Sprintf("%s INTO %s (", verb, table)
 	for _, c := range columns {
 		query += fmt.Sprintf("%s,", c)
 	}
@@ -73,13 +90,29 @@ func insertDB(r *http.Request, db *sql.DB, table string, columns []string, recor
 	//log.Debugf(ctx, "query: %v", query)
 	rows, err := db.Query(query)
 	if err != nil {
-		log.Errorf(ctx, "failed to insert table: %s, err: %v, query: %v", table, err, query)
+		log.Errorf(ctx, "failed to write table: %s, err: %v, query: %v", table, err, query)
 		return 0, err
 	}
 	defer rows.Close()
 	return targetNum, nil
 }
 
+// UPDATEやDELETEなど結果の行を返さないqueryを実行して、影響を受けた行数を返す
+func execDB(r *http.Request, db sqlRunner, query string) (int64, error) {
+	ctx := appengine.NewContext(r)
+	log.Infof(ctx, "exec query: %s", query)
+
+	res, err := db.Exec(query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to exec. query: [%s], err: %v", query, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get RowsAffected. query: [%s], err: %v", query, err)
+	}
+	return n, nil
+}
+
 func showDatabases(w http.ResponseWriter, db *sql.DB) {
 	w.Header().Set("Content-Type", "text/plain")
 
@@ -105,7 +138,7 @@ func showDatabases(w http.ResponseWriter, db *sql.DB) {
 
 // TODO: 以下のようなことがあったのでRetry入れる
 // failed to calcKahanshin. code: 5471, err: failed to getOrderedDateCloses. code: 5471, err: failed to selectTable failed to select. query: [SELECT date, close FROM daily WHERE code = 5471 AND date <= '2019/06/03' ORDER BY date DESC LIMIT 2;], err: invalid connection
-func selectTable(r *http.Request, db *sql.DB, q string) ([]string, error) {
+func selectTable(r *http.Request, db sqlRunner, q string) ([]string, error) {
 	ctx := appengine.NewContext(r)
 	log.Infof(ctx, "select query: %s", q)
 
@@ -0,0 +1,225 @@
+// dailyを週足、月足にまとめ直して、日足と同じ移動平均とPPPの判定をする
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/appengine" // Required external App Engine library
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// 直近の月足timeframeStoreBars本それぞれで100本移動平均を求めるのに必要な日数
+	// 最初の月は途中からになるので除き、112ヶ月分(一月あたり約21取引日)を取得する
+	timeframeHistoryDays = 2400
+	// 週足、月足を直近から何本保存するか
+	timeframeStoreBars = 10
+	// 週足、月足の一番長い移動平均の本数
+	timeframeLongestMoving = 100
+)
+
+// 週足と月足
+const (
+	weekly  = "weekly"
+	monthly = "monthly"
+)
+
+var timeframes = []string{weekly, monthly}
+
+// timeframesテーブルの項目名
+var timeframeColumns = []string{"code", "timeframe", "period", "date", "open", "high", "low", "close", "turnover",
+	"moving5", "moving20", "moving60", "moving100", "ppp"}
+
+// 週足、月足のPPPの種類と日足のPPPとの一致
+type timeframeInfo struct {
+	WeeklyPPP    pppKind // 週足の5, 20, 60, 100本移動平均によるPPPの種類
+	MonthlyPPP   pppKind // 月足の5, 20, 60, 100本移動平均によるPPPの種類
+	PPPAgreement bool    // 日足と週足のPPPの種類が一致するか
+}
+
+// 日付から週足、月足のどの期間に入るかを返す
+// 週足はISO週(月曜始まり)で「2019-W20」, 月足は「2019/05」の形式
+func periodOf(date string, timeframe string) (string, error) {
+	t, err := time.Parse("2006/01/02", date)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse date. %v", err)
+	}
+	if timeframe == weekly {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w), nil
+	}
+	return t.Format("2006/01"), nil
+}
+
+// 古い順に並べた日足を週足または月足にまとめる
+// dailyには取引日のデータしかないので、休日は自然に除かれて取引所のカレンダーに沿った足になる
+// 足の日付はその期間の最後の取引日で、まだ終わっていない期間は直近の日付までの足になる
+func resampleBars(bars []ohlc, timeframe string) ([]ohlc, []string, error) {
+	var resampled []ohlc
+	var periods []string
+	for _, b := range bars {
+		period, err := periodOf(b.Date, timeframe)
+		if err != nil {
+			return nil, nil, err
+		}
+		n := len(resampled)
+		if n == 0 || periods[n-1] != period {
+			resampled = append(resampled, b)
+			periods = append(periods, period)
+			continue
+		}
+		last := &resampled[n-1]
+		last.Date = b.Date
+		if b.High > last.High {
+			last.High = b.High
+		}
+		if b.Low < last.Low {
+			last.Low = b.Low
+		}
+		last.Close = b.Close
+		last.Turnover += b.Turnover
+	}
+	return resampled, periods, nil
+}
+
+// 古い順に並べた日足からtimeframesテーブルのレコードを作る
+// 移動平均は日足と同じmovingAverageで計算するため直近の順にして渡す
+// movingAverageはデータが足りないと残りの本数で平均してしまうので、
+// 途中から始まる最初の足を除いて100本そろった足だけを保存する
+func calcTimeframeRecords(r *http.Request, code string, bars []ohlc, timeframe string) ([][]string, error) {
+	resampled, periods, err := resampleBars(bars, timeframe)
+	if err != nil {
+		return nil, err
+	}
+	dcs := make([]dateClose, len(resampled))
+	for i, b := range resampled {
+		dcs[len(resampled)-1-i] = dateClose{Date: b.Date, Close: b.Close}
+	}
+	m5 := movingAverage(r, dcs, 5)
+	m20 := movingAverage(r, dcs, 20)
+	m60 := movingAverage(r, dcs, 60)
+	m100 := movingAverage(r, dcs, 100)
+
+	var records [][]string
+	begin := len(resampled) - timeframeStoreBars
+	if begin < timeframeLongestMoving {
+		begin = timeframeLongestMoving
+	}
+	for i := begin; i < len(resampled); i++ {
+		b := resampled[i]
+		ms := movings{m5[b.Date], m20[b.Date], m60[b.Date], m100[b.Date]}
+		records = append(records, []string{code, timeframe, periods[i], b.Date,
+			fmt.Sprintf("%f", b.Open), fmt.Sprintf("%f", b.High), fmt.Sprintf("%f", b.Low), fmt.Sprintf("%f", b.Close),
+			fmt.Sprintf("%f", b.Turnover),
+			fmt.Sprintf("%f", ms.Moving5), fmt.Sprintf("%f", ms.Moving20), fmt.Sprintf("%f", ms.Moving60), fmt.Sprintf("%f", ms.Moving100),
+			ms.calcPPPKind().String()})
+	}
+	return records, nil
+}
+
+// dailyから週足、月足とそのPPPの種類を計算してtimeframesテーブルに書き込むHandler
+// 途中の期間の足は毎日更新されるので上書きする
+func timeframeHandler(w http.ResponseWriter, r *http.Request) {
+	processStartTime := time.Now().UTC()
+	// GAE log
+	ctx := appengine.NewContext(r)
+
+	// get environment var, sheet, db
+	sheet, db, err := initialize(r)
+	if err != nil {
+		log.Errorf(ctx, "failed to initialize. err: %v", err)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to initialize. got environment var, sheet, db.")
+
+	// 休日データを取得
+	reg := getCalendarRegistry(r, sheet, db)
+	// 前の日がどの取引所でも休みの日だったら取得すべきデータがないので起動しない
+	if runEnv != "test" && !reg.PreviousDayOpen() {
+		log.Infof(ctx, "Previous day is not business day.")
+		return
+	}
+
+	// codesの指定がなければ最新の日付にある銘柄を取得
+	codes, err := getCodesParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(codes) == 0 {
+		codes, err = selectLatestCodes(r, db)
+		if err != nil {
+			log.Errorf(ctx, "failed to selectLatestCodes %v", err)
+			os.Exit(0)
+		}
+	}
+
+	targetRecordNum := 0
+	insertedRecordNum := 0
+	for _, code := range codes {
+		// test環境ではデータの存在する最新の日付に合わせる
+		previousBussinessDay := "2019/05/16"
+		// prod環境の場合は、銘柄の取引所の直近の取引日を取得する
+		if runEnv != "test" {
+			previousBussinessDay = reg.PreviousBussinessDay(code)
+		}
+		bars, err := getOrderedOHLCs(r, db, code, previousBussinessDay, timeframeHistoryDays)
+		if err != nil {
+			log.Errorf(ctx, "failed to getOrderedOHLCs. code: %s, err: %v", code, err)
+			continue
+		}
+		reverseOHLCs(bars)
+
+		for _, tf := range timeframes {
+			records, err := calcTimeframeRecords(r, code, bars, tf)
+			if err != nil {
+				log.Errorf(ctx, "failed to calcTimeframeRecords. code: %s, timeframe: %s, err: %v", code, tf, err)
+				continue
+			}
+			if len(records) == 0 {
+				log.Infof(ctx, "not enough bars for %s. code: %s", tf, code)
+				continue
+			}
+			targetRecordNum += len(records)
+			ins, err := replaceDB(r, db, "timeframes", timeframeColumns, records)
+			if err != nil {
+				log.Errorf(ctx, "failed to replaceDB. code: %s, timeframe: %s, err: %v", code, tf, err)
+				continue
+			}
+			insertedRecordNum += ins
+		}
+	}
+	if targetRecordNum != insertedRecordNum {
+		log.Errorf(ctx, "failed to write all records. target: %d, inserted: %d", targetRecordNum, insertedRecordNum)
+		os.Exit(0)
+	}
+	log.Infof(ctx, "succeeded to write all records. target: %d, inserted: %d", targetRecordNum, insertedRecordNum)
+	log.Infof(ctx, "done timeframeHandler. Elapsed time %v.", time.Since(processStartTime))
+}
+
+// 銘柄コード、日付を渡すとその日付を含む週足、月足のPPPの種類と日足のPPPとの一致を返す
+func getTimeframeInfo(r *http.Request, db *sql.DB, code string, date string, dailyPPP pppKind) (timeframeInfo, error) {
+	var kinds [2]pppKind
+	for i, tf := range timeframes {
+		period, err := periodOf(date, tf)
+		if err != nil {
+			return timeframeInfo{}, err
+		}
+		ret, err := selectTable(r, db, fmt.Sprintf(
+			"SELECT ppp FROM timeframes WHERE code = %s and timeframe = '%s' and period = '%s';", code, tf, period))
+		if err != nil {
+			return timeframeInfo{}, fmt.Errorf("failed to selectTable %v", err)
+		}
+		if len(ret) != 1 {
+			return timeframeInfo{}, fmt.Errorf("no selected data. timeframe: %s, period: %s", tf, period)
+		}
+		if kinds[i], err = parsePPPKind(ret[0]); err != nil {
+			return timeframeInfo{}, err
+		}
+	}
+	return timeframeInfo{WeeklyPPP: kinds[0], MonthlyPPP: kinds[1], PPPAgreement: dailyPPP == kinds[0]}, nil
+}
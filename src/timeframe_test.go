@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func bar(date string, open, high, low, close, turnover float64) ohlc {
+	return ohlc{Date: date, Open: open, High: high, Low: low, Close: close, Turnover: turnover}
+}
+
+func TestPeriodOf(t *testing.T) {
+	tests := []struct {
+		date      string
+		timeframe string
+		want      string
+	}{
+		{"2019/05/17", weekly, "2019-W20"},
+		// 2018/12/31(月)はISO週では2019年の第1週
+		{"2018/12/31", weekly, "2019-W01"},
+		{"2018/12/28", weekly, "2018-W52"},
+		// 2021/01/01(金)はISO週では2020年の第53週
+		{"2021/01/01", weekly, "2020-W53"},
+		{"2018/12/31", monthly, "2018/12"},
+		{"2019/01/04", monthly, "2019/01"},
+	}
+	for _, tt := range tests {
+		got, err := periodOf(tt.date, tt.timeframe)
+		if err != nil || got != tt.want {
+			t.Errorf("periodOf(%s, %s) = %s, %v, want %s", tt.date, tt.timeframe, got, err, tt.want)
+		}
+	}
+	if _, err := periodOf("2019-05-17", weekly); err == nil {
+		t.Errorf("periodOf() with invalid date: want error")
+	}
+}
+
+func TestResampleBars(t *testing.T) {
+	// 年末年始をまたぐ日足. 2018/12/31〜2019/01/03は東証の休み
+	yearEnd := []ohlc{
+		bar("2018/12/27", 100, 105, 99, 104, 10),
+		bar("2018/12/28", 104, 106, 101, 102, 20),
+		bar("2019/01/04", 98, 99, 95, 96, 30),
+		bar("2019/01/07", 96, 100, 94, 99, 40),
+		bar("2019/01/08", 99, 103, 98, 101, 50),
+	}
+	// 2019/07/15(月)は海の日で休み、07/18は取得できなかった日
+	holidayWeek := []ohlc{
+		bar("2019/07/12", 200, 202, 198, 201, 5),
+		bar("2019/07/16", 201, 204, 200, 203, 6),
+		bar("2019/07/17", 203, 210, 202, 208, 7),
+		bar("2019/07/19", 208, 209, 190, 195, 8),
+		bar("2019/07/22", 195, 197, 193, 196, 9),
+	}
+	tests := []struct {
+		name        string
+		bars        []ohlc
+		timeframe   string
+		want        []ohlc
+		wantPeriods []string
+	}{
+		{
+			name:      "weekly across year boundary",
+			bars:      yearEnd,
+			timeframe: weekly,
+			want: []ohlc{
+				bar("2018/12/28", 100, 106, 99, 102, 30),
+				bar("2019/01/04", 98, 99, 95, 96, 30),
+				bar("2019/01/08", 96, 103, 94, 101, 90),
+			},
+			wantPeriods: []string{"2018-W52", "2019-W01", "2019-W02"},
+		},
+		{
+			name:      "monthly across year boundary",
+			bars:      yearEnd,
+			timeframe: monthly,
+			want: []ohlc{
+				bar("2018/12/28", 100, 106, 99, 102, 30),
+				bar("2019/01/08", 98, 103, 94, 101, 120),
+			},
+			wantPeriods: []string{"2018/12", "2019/01"},
+		},
+		{
+			name:      "weekly partial week with holiday",
+			bars:      holidayWeek,
+			timeframe: weekly,
+			want: []ohlc{
+				bar("2019/07/12", 200, 202, 198, 201, 5),
+				bar("2019/07/19", 201, 210, 190, 195, 21),
+				bar("2019/07/22", 195, 197, 193, 196, 9),
+			},
+			wantPeriods: []string{"2019-W28", "2019-W29", "2019-W30"},
+		},
+		{
+			name:        "no bars",
+			bars:        nil,
+			timeframe:   weekly,
+			want:        nil,
+			wantPeriods: nil,
+		},
+	}
+	for _, tt := range tests {
+		got, periods, err := resampleBars(tt.bars, tt.timeframe)
+		if err != nil {
+			t.Errorf("%s: resampleBars() error: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resampleBars() = %v, want %v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(periods, tt.wantPeriods) {
+			t.Errorf("%s: resampleBars() periods = %v, want %v", tt.name, periods, tt.wantPeriods)
+		}
+	}
+
+	// まとめても元の日足は書き換えない
+	if yearEnd[0] != bar("2018/12/27", 100, 105, 99, 104, 10) {
+		t.Errorf("resampleBars() modified input: %v", yearEnd[0])
+	}
+
+	if _, _, err := resampleBars([]ohlc{bar("2019-01-04", 1, 1, 1, 1, 1)}, weekly); err == nil {
+		t.Errorf("resampleBars() with invalid date: want error")
+	}
+}
@@ -0,0 +1,113 @@
+// 高値と安値を使うストキャスティクスとATRの計算をこのコードにまとめる
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// ストキャスティクスとATRの期間
+const (
+	stochasticDays = 14 // %Kの期間
+	stochasticD    = 3  // %Dの平滑化の期間
+	atrDays        = 14
+)
+
+// ストキャスティクスとATRの値
+type volatilityInfo struct {
+	FastK      float64 // ファスト%K(14)
+	FastD      float64 // ファスト%D(3)
+	SlowK      float64 // スロー%K(ファスト%Dと同じ)
+	SlowD      float64 // スロー%D(3)
+	ATR14      float64 // 14日ATR
+	ATRPercent float64 // 終値に対するATRの比率(%)
+}
+
+// 古い順に並べた四本値からファスト%Kを求める
+// 期間中の高値と安値が同じ場合は50とする
+func stochasticK(bars []ohlc, period int) []float64 {
+	ret := make([]float64, len(bars))
+	for i := range bars {
+		begin := i - period + 1
+		if begin < 0 {
+			begin = 0
+		}
+		high, low := bars[begin].High, bars[begin].Low
+		for j := begin + 1; j <= i; j++ {
+			high = math.Max(high, bars[j].High)
+			low = math.Min(low, bars[j].Low)
+		}
+		if high == low {
+			ret[i] = 50
+			continue
+		}
+		ret[i] = (bars[i].Close - low) / (high - low) * 100
+	}
+	return ret
+}
+
+// 古い順に並べた四本値からATRを求める
+// 真の値幅をRSIと同じく最初のperiod日は単純平均、それ以降はWilderの方法で平滑化する
+func atr(bars []ohlc, period int) []float64 {
+	ret := make([]float64, len(bars))
+	var avg float64
+	for i, b := range bars {
+		tr := b.High - b.Low
+		if i > 0 {
+			prev := bars[i-1].Close
+			tr = math.Max(tr, math.Max(math.Abs(b.High-prev), math.Abs(b.Low-prev)))
+		}
+		if i < period {
+			avg += tr / float64(period)
+			ret[i] = avg * float64(period) / float64(i+1)
+			continue
+		}
+		avg = (avg*float64(period-1) + tr) / float64(period)
+		ret[i] = avg
+	}
+	return ret
+}
+
+// 古い順に並べた四本値からvolatilitiesテーブルのレコードを作る
+func calcVolatilityRecords(code string, bars []ohlc) [][]string {
+	fastK := stochasticK(bars, stochasticDays)
+	fastD := sma(fastK, stochasticD)
+	slowD := sma(fastD, stochasticD)
+	atrs := atr(bars, atrDays)
+
+	var records [][]string
+	// スロー%Dがそろうのは%Kの期間に平滑化を二回した後
+	for i := storeStart(len(bars), stochasticDays+stochasticD*2); i < len(bars); i++ {
+		atrPercent := 0.0
+		if bars[i].Close != 0 {
+			atrPercent = atrs[i] / bars[i].Close * 100
+		}
+		records = append(records, []string{code, bars[i].Date,
+			fmt.Sprintf("%f", fastK[i]), fmt.Sprintf("%f", fastD[i]), fmt.Sprintf("%f", fastD[i]), fmt.Sprintf("%f", slowD[i]),
+			fmt.Sprintf("%f", atrs[i]), fmt.Sprintf("%f", atrPercent)})
+	}
+	return records
+}
+
+// 銘柄コード、日付を渡すと該当のvolatilityInfo structに対応するストキャスティクスとATRの値を返す
+func getVolatilityInfo(r *http.Request, db *sql.DB, code string, date string) (volatilityInfo, error) {
+	ret, err := selectTable(r, db, fmt.Sprintf(
+		"SELECT fastk, fastd, slowk, slowd, atr14, atrpercent FROM volatilities WHERE code = %s and date = '%s';", code, date))
+	if err != nil {
+		return volatilityInfo{}, fmt.Errorf("failed to selectTable %v", err)
+	}
+	if len(ret) != 6 {
+		return volatilityInfo{}, fmt.Errorf("no selected data")
+	}
+
+	var fs [6]float64
+	for i := range fs {
+		if fs[i], err = strconv.ParseFloat(ret[i], 64); err != nil {
+			return volatilityInfo{}, fmt.Errorf("failed to ParseFloat %v", err)
+		}
+	}
+	return volatilityInfo{fs[0], fs[1], fs[2], fs[3], fs[4], fs[5]}, nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// 高値、安値、終値だけの四本値
+var volatilityBars = []ohlc{
+	{High: 10, Low: 8, Close: 9},
+	{High: 11, Low: 9, Close: 10},
+	{High: 12, Low: 10, Close: 11},
+	{High: 11, Low: 7, Close: 8},
+	{High: 9, Low: 8, Close: 9},
+}
+
+func TestStochasticK(t *testing.T) {
+	got := stochasticK(volatilityBars, 3)
+	want := []float64{50, 200.0 / 3, 75, 20, 40}
+	for i := range want {
+		if !almostEqual(got[i], want[i], 1e-9) {
+			t.Errorf("stochasticK[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// 期間中の高値と安値が同じ場合は0で割らずに50
+	flat := []ohlc{{High: 5, Low: 5, Close: 5}, {High: 5, Low: 5, Close: 5}}
+	for i, v := range stochasticK(flat, 3) {
+		if v != 50 {
+			t.Errorf("stochasticK of flat bars[%d] = %v, want 50", i, v)
+		}
+	}
+}
+
+func TestATR(t *testing.T) {
+	// 真の値幅は 2, 2, 2, 4(前日終値11から安値7), 1
+	got := atr(volatilityBars, 3)
+	want := []float64{2, 2, 2, 8.0 / 3, 19.0 / 9}
+	for i := range want {
+		if !almostEqual(got[i], want[i], 1e-9) {
+			t.Errorf("atr[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if got := atr(nil, 14); len(got) != 0 {
+		t.Errorf("atr(nil) = %v, want empty", got)
+	}
+}